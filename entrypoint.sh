@@ -13,6 +13,65 @@ if [ -n "$GH_APP_PRIVATE_KEY_FILE" ]; then
   set -- "$@" -p "$GH_APP_PRIVATE_KEY_FILE"
 fi
 
+# pass jwt-signer-command flag from JWT_SIGNER_COMMAND environment variable if it exists
+if [ -n "$JWT_SIGNER_COMMAND" ]; then
+  set -- "$@" -jwt-signer-command "$JWT_SIGNER_COMMAND"
+fi
+
+# pass installation flags from INSTALLATION_ID and INSTALLATION_OWNER environment variables if they exist
+if [ -n "$INSTALLATION_ID" ]; then
+  set -- "$@" -installation-id "$INSTALLATION_ID"
+fi
+if [ -n "$INSTALLATION_OWNER" ]; then
+  set -- "$@" -installation-owner "$INSTALLATION_OWNER"
+fi
+
+# pass keep-token flag when KEEP_TOKEN environment variable is true
+if [ "$KEEP_TOKEN" = "true" ]; then
+  set -- "$@" -keep-token
+fi
+
+# pass token-permissions flag from TOKEN_PERMISSIONS environment variable if it exists
+if [ -n "$TOKEN_PERMISSIONS" ]; then
+  set -- "$@" -token-permissions "$TOKEN_PERMISSIONS"
+fi
+
+# pass api-url flag from API_URL environment variable if it exists
+if [ -n "$API_URL" ]; then
+  set -- "$@" -api-url "$API_URL"
+fi
+
+# pass proxy flag from PROXY environment variable if it exists
+if [ -n "$PROXY" ]; then
+  set -- "$@" -proxy "$PROXY"
+fi
+
+# pass ca-bundle flag from CA_BUNDLE environment variable if it exists
+if [ -n "$CA_BUNDLE" ]; then
+  set -- "$@" -ca-bundle "$CA_BUNDLE"
+fi
+
+# pass client certificate flags from CLIENT_CERT and CLIENT_KEY environment variables if they exist
+if [ -n "$CLIENT_CERT" ]; then
+  set -- "$@" -client-cert "$CLIENT_CERT"
+fi
+if [ -n "$CLIENT_KEY" ]; then
+  set -- "$@" -client-key "$CLIENT_KEY"
+fi
+
+# pass retry-budget flag from RETRY_BUDGET environment variable if it exists
+if [ -n "$RETRY_BUDGET" ]; then
+  set -- "$@" -retry-budget "$RETRY_BUDGET"
+fi
+
+# pass timeout flags from REQUEST_TIMEOUT and TIMEOUT environment variables if they exist
+if [ -n "$REQUEST_TIMEOUT" ]; then
+  set -- "$@" -request-timeout "$REQUEST_TIMEOUT"
+fi
+if [ -n "$TIMEOUT" ]; then
+  set -- "$@" -timeout "$TIMEOUT"
+fi
+
 # pass repository flag from REPOSITORY environment variable if it exists
 if [ -n "$REPOSITORY" ]; then
   set -- "$@" -r "$REPOSITORY"
@@ -28,8 +87,8 @@ if [ -n "$HEAD_BRANCH" ]; then
   set -- "$@" -h "$HEAD_BRANCH"
 fi
 
-# pass force flag from FORCE_PUSH environment variable if it exists
-if [ -n "$FORCE_PUSH" ]; then
+# pass force flag when FORCE_PUSH environment variable is true
+if [ "$FORCE_PUSH" = "true" ]; then
   set -- "$@" -f
 fi
 
@@ -43,9 +102,9 @@ if [ -n "$COMMIT_MSG" ]; then
   set -- "$@" -m "$COMMIT_MSG"
 fi
 
-# pass addNewFiles flag ADD_NEW_FILES environment variable if it exists
-if [ -n "$ADD_NEW_FILES" ]; then
-  set -- "$@" -a
+# disable addNewFiles flag when ADD_NEW_FILES environment variable is false, it is enabled by default
+if [ "$ADD_NEW_FILES" = "false" ]; then
+  set -- "$@" -a=false
 fi
 
 # pass coauthors flag from COAUTHORS environment variable if it exists
@@ -53,8 +112,43 @@ if [ -n "$COAUTHORS" ]; then
   set -- "$@" -c "$COAUTHORS"
 fi
 
+# pass staged-only flag when STAGED_ONLY environment variable is true
+if [ "$STAGED_ONLY" = "true" ]; then
+  set -- "$@" -staged-only
+fi
+
+# pass content-source flag from CONTENT_SOURCE environment variable if it exists
+if [ -n "$CONTENT_SOURCE" ]; then
+  set -- "$@" -content-source "$CONTENT_SOURCE"
+fi
+
+# pass upload-concurrency flag from UPLOAD_CONCURRENCY environment variable if it exists
+if [ -n "$UPLOAD_CONCURRENCY" ]; then
+  set -- "$@" -upload-concurrency "$UPLOAD_CONCURRENCY"
+fi
+
+# pass allow-empty flag when ALLOW_EMPTY environment variable is true
+if [ "$ALLOW_EMPTY" = "true" ]; then
+  set -- "$@" -allow-empty
+fi
+
+# pass push-retries flag from PUSH_RETRIES environment variable if it exists
+if [ -n "$PUSH_RETRIES" ]; then
+  set -- "$@" -push-retries "$PUSH_RETRIES"
+fi
+
+# pass files flag from FILES environment variable if it exists
+if [ -n "$FILES" ]; then
+  set -- "$@" -files "$FILES"
+fi
+
+# pass exclude flag from EXCLUDE environment variable if it exists
+if [ -n "$EXCLUDE" ]; then
+  set -- "$@" -exclude "$EXCLUDE"
+fi
+
 # print the version of the action
 echo "Github app commit action: $(/bin/action -version)\n"
 
-# execute the action with the arguments
-/bin/action "$@"
\ No newline at end of file
+# execute the action with the arguments, replacing the shell so it receives the cancel signals
+exec /bin/action "$@"
\ No newline at end of file
@@ -0,0 +1,93 @@
+package github_helper
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type APIErrorDetail struct {
+	Resource string `json:"resource"`
+	Field    string `json:"field"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+}
+
+// APIError is returned by CallGithubAPI when GitHub answers with an unsuccessful status code
+type APIError struct {
+	StatusCode       int              `json:"-"`
+	Message          string           `json:"message"`
+	DocumentationUrl string           `json:"documentation_url"`
+	Errors           []APIErrorDetail `json:"errors,omitempty"`
+	Response         string           `json:"-"` // raw response body
+}
+
+var (
+	// ErrTokenNotInitialized is returned by the repository api calls before SetGithubAppToken is called
+	ErrTokenNotInitialized = errors.New("GitHub App Token not initialized")
+	// ErrConflict is returned when the target branch has changes that conflict with the commit
+	ErrConflict = errors.New("conflicting changes in branch")
+)
+
+func (e *APIError) Error() string {
+	message := e.Message
+	if message == "" {
+		message = e.Response
+	}
+	for _, detail := range e.Errors {
+		if detail.Message != "" {
+			message = fmt.Sprintf("%s; %s", message, detail.Message)
+		}
+	}
+	if e.DocumentationUrl != "" {
+		return fmt.Sprintf("error calling github api, status code: %d, message: %s, documentation: %s", e.StatusCode, message, e.DocumentationUrl)
+	}
+	return fmt.Sprintf("error calling github api, status code: %d, message: %s", e.StatusCode, message)
+}
+
+// the error is an APIError with the given status code
+func hasStatusCode(err error, statusCode int) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == statusCode
+}
+
+// the error is an APIError whose message contains the given text, ignoring case
+func hasMessage(err error, text string) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return strings.Contains(strings.ToLower(apiErr.Message), strings.ToLower(text))
+}
+
+// IsNotFound reports whether the resource doesn't exist or isn't visible to the token
+func IsNotFound(err error) bool {
+	return hasStatusCode(err, http.StatusNotFound)
+}
+
+// IsReferenceNotFound reports whether a reference update failed because the reference doesn't
+// exist. A 404 means the repository isn't visible to the token instead
+func IsReferenceNotFound(err error) bool {
+	return hasStatusCode(err, http.StatusUnprocessableEntity) && hasMessage(err, "reference does not exist")
+}
+
+// IsNonFastForward reports whether a reference update failed because the reference moved
+func IsNonFastForward(err error) bool {
+	return hasStatusCode(err, http.StatusUnprocessableEntity) && hasMessage(err, "not a fast forward")
+}
+
+// IsProtectedBranch reports whether a reference update was rejected by a branch protection or ruleset
+func IsProtectedBranch(err error) bool {
+	return hasMessage(err, "protected branch") || hasMessage(err, "rule violation")
+}
+
+// IsUnauthorized reports whether the credentials were rejected, e.g. a jwt signed with a revoked key
+func IsUnauthorized(err error) bool {
+	return hasStatusCode(err, http.StatusUnauthorized)
+}
+
+// IsPermissionDenied reports whether the token isn't allowed to perform the request
+func IsPermissionDenied(err error) bool {
+	return hasStatusCode(err, http.StatusForbidden) || hasStatusCode(err, http.StatusUnauthorized)
+}
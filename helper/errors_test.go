@@ -0,0 +1,101 @@
+package github_helper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// build the error like sendRequest does from a GitHub response
+func apiError(t *testing.T, statusCode int, body string) *APIError {
+	t.Helper()
+	apiErr := &APIError{StatusCode: statusCode, Response: body}
+	err := json.Unmarshal([]byte(body), apiErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return apiErr
+}
+
+func TestErrorClassification(t *testing.T) {
+	// response bodies of PATCH /repos/{owner}/{repo}/git/refs/{ref}
+	tests := []struct {
+		name               string
+		err                error
+		wantRefNotFound    bool
+		wantNonFastForward bool
+		wantProtected      bool
+		wantPermission     bool
+		wantNotFound       bool
+		wantUnauthorized   bool
+	}{
+		{
+			name:               "not a fast forward",
+			err:                apiError(t, http.StatusUnprocessableEntity, `{"message":"Update is not a fast forward","documentation_url":"https://docs.github.com/rest/git/refs#update-a-reference","status":"422"}`),
+			wantNonFastForward: true,
+		},
+		{
+			name:            "reference does not exist",
+			err:             apiError(t, http.StatusUnprocessableEntity, `{"message":"Reference does not exist","documentation_url":"https://docs.github.com/rest/git/refs#update-a-reference","status":"422"}`),
+			wantRefNotFound: true,
+		},
+		{
+			name:          "protected branch",
+			err:           apiError(t, http.StatusUnprocessableEntity, `{"message":"Protected branch update failed for refs/heads/main.","documentation_url":"https://docs.github.com/rest/git/refs#update-a-reference","status":"422"}`),
+			wantProtected: true,
+		},
+		{
+			name:          "repository rule violations",
+			err:           apiError(t, http.StatusUnprocessableEntity, `{"message":"Repository rule violations found\n\nChanges must be made through a pull request.\n\n","documentation_url":"https://docs.github.com/rest/git/refs#update-a-reference","status":"422"}`),
+			wantProtected: true,
+		},
+		{
+			name:           "resource not accessible",
+			err:            apiError(t, http.StatusForbidden, `{"message":"Resource not accessible by integration","documentation_url":"https://docs.github.com/rest/git/refs#update-a-reference","status":"403"}`),
+			wantPermission: true,
+		},
+		{
+			name:             "bad credentials",
+			err:              apiError(t, http.StatusUnauthorized, `{"message":"Bad credentials","documentation_url":"https://docs.github.com/rest","status":"401"}`),
+			wantPermission:   true,
+			wantUnauthorized: true,
+		},
+		{
+			name:         "repository not visible",
+			err:          apiError(t, http.StatusNotFound, `{"message":"Not Found","documentation_url":"https://docs.github.com/rest/git/refs#update-a-reference","status":"404"}`),
+			wantNotFound: true,
+		},
+		{
+			name:               "wrapped",
+			err:                fmt.Errorf("error updating branch: %w", apiError(t, http.StatusUnprocessableEntity, `{"message":"Update is not a fast forward","status":"422"}`)),
+			wantNonFastForward: true,
+		},
+		{
+			name: "not an api error",
+			err:  errors.New("Reference does not exist"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checks := []struct {
+				name string
+				got  bool
+				want bool
+			}{
+				{"IsReferenceNotFound", IsReferenceNotFound(tt.err), tt.wantRefNotFound},
+				{"IsNonFastForward", IsNonFastForward(tt.err), tt.wantNonFastForward},
+				{"IsProtectedBranch", IsProtectedBranch(tt.err), tt.wantProtected},
+				{"IsPermissionDenied", IsPermissionDenied(tt.err), tt.wantPermission},
+				{"IsNotFound", IsNotFound(tt.err), tt.wantNotFound},
+				{"IsUnauthorized", IsUnauthorized(tt.err), tt.wantUnauthorized},
+			}
+			for _, check := range checks {
+				if check.got != check.want {
+					t.Errorf("%s = %v, want %v", check.name, check.got, check.want)
+				}
+			}
+		})
+	}
+}
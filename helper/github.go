@@ -2,278 +2,328 @@ package github_helper
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
+)
+
+// Client calls the GitHub API with the credentials of a GitHub App. The installation token
+// is set with SetGithubAppToken, and repository calls are made against the token repository
+type Client struct {
+	HttpClient  *http.Client
+	BaseUrl     string
+	RetryBudget time.Duration // maximum time spent retrying failed api calls, shared by all the calls of the client
+	// timeout of a single api request, including reading the response. No timeout when zero
+	RequestTimeout time.Duration
+	// permissions requested for the installation token, e.g. contents: write. All
+	// the installation permissions when empty
+	TokenPermissions map[string]string
+	// app installation of the token, looked up from the repository when zero
+	InstallationId int
+	// organization or user to look the installation up from instead of the repository,
+	// e.g. when the app can't see the repository yet
+	InstallationOwner string
+	appId             string
+	signers           []Signer         // app key signers, tried in order when generating the installation token
+	signer            Signer           // app key signer in use, used to sign the jwt again when it expires
+	signerIndex       int              // index of the signer in use in signers
+	signedToken       string           // app jwt
+	jwtExpiresAt      time.Time        // expiration of the app jwt
+	appToken          *GitHubAppToken  // installation token
+	replacedTokens    []GitHubAppToken // installation tokens replaced when they were about to expire
+	rateLimit         RateLimit        // last rate limit reported by github
+	retrySpent        time.Duration    // retry budget used by all the calls
+	mu                sync.Mutex
+	tokenMu           sync.Mutex // guards the jwt and installation token refresh
+}
 
-	"github.com/golang-jwt/jwt"
+const (
+	defaultBaseUrl = "https://api.github.com"
 )
 
 var (
-	TOKEN_TTL          = int64(5)
-	initJwt, initToken sync.Once
-	ghAppSignedToken   string
-	ghAppToken         *GitHubAppToken = nil
+	TOKEN_TTL = int64(5)
 )
 
-func initAppToken(appId string, privatePem []byte) {
-	initJwt.Do(func() {
-		token, err := GenerateToken(appId, privatePem)
-		if err != nil {
-			panic(err)
-		}
-		ghAppSignedToken = token
-	})
+func NewClient(appId string) *Client {
+	return &Client{
+		HttpClient:     &http.Client{},
+		BaseUrl:        defaultBaseUrl,
+		RetryBudget:    DefaultRetryBudget,
+		RequestTimeout: DefaultRequestTimeout,
+		TokenPermissions: map[string]string{
+			"contents": "write",
+		},
+		appId: appId,
+	}
 }
 
-func SetGithubAppToken(token *GitHubAppToken) {
-	initToken.Do(func() {
-		if token == nil {
-			panic("GitHub App Token not provided")
-		}
-		ghAppToken = token
-	})
+// set the api base url. A GitHub Enterprise Server url without path, like
+// 'https://github.example.com', is completed with the '/api/v3' path
+func (c *Client) SetBaseUrl(baseUrl string) error {
+	apiUrl, err := url.Parse(strings.TrimSpace(baseUrl))
+	if err != nil {
+		return fmt.Errorf("invalid api url '%s': %w", baseUrl, err)
+	}
+	if (apiUrl.Scheme != "https" && apiUrl.Scheme != "http") || apiUrl.Host == "" {
+		return fmt.Errorf("invalid api url '%s', expected an url like 'https://api.github.com'", baseUrl)
+	}
+	apiUrl.Path = strings.TrimSuffix(apiUrl.Path, "/")
+	if apiUrl.Path == "" && !strings.HasPrefix(apiUrl.Hostname(), "api.") {
+		// github enterprise server serves the api under /api/v3
+		apiUrl.Path = "/api/v3"
+	}
+	c.BaseUrl = apiUrl.String()
+	return nil
 }
 
-// generate jwt token
-func GenerateToken(githubAppId string, privatePem []byte) (string, error) {
-	// parse private key
-	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(privatePem)
+// sign the app jwt with the pem private keys, decrypted with passphrase when encrypted.
+// With several keys, e.g. during a key rotation, they are tried in order
+func (c *Client) SignJWTAppToken(ctx context.Context, privatePem []byte, passphrase string) error {
+	privateKeys, err := ParsePrivateKeys(privatePem, passphrase)
 	if err != nil {
-		return "", fmt.Errorf(`error parsing private key, %v`, err)
+		return err
+	}
+	signers := make([]Signer, 0, len(privateKeys))
+	for _, privateKey := range privateKeys {
+		signers = append(signers, NewRSASigner(privateKey))
 	}
+	return c.SetSigners(ctx, signers...)
+}
 
-	// create the jwt token
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
-		"iat": time.Now().Unix(), // Convert int64 to string
-		"exp": time.Now().Add(time.Minute * 5).Unix(),
-		"iss": githubAppId, //871426, //49337552, //
-	})
+// sign the app jwt with signer, e.g. a command calling a KMS holding the app key
+func (c *Client) SetSigner(ctx context.Context, signer Signer) error {
+	return c.SetSigners(ctx, signer)
+}
 
-	// sign the token using the private key
-	tokenString, err := token.SignedString(privateKey)
-	if err != nil {
-		return "", fmt.Errorf(`error signing jwt token, %v`, err)
-	}
+// sign the app jwt with the first signer. The others are tried in order when GitHub
+// rejects the jwt while generating the installation token
+func (c *Client) SetSigners(ctx context.Context, signers ...Signer) error {
+	if len(signers) == 0 {
+		return fmt.Errorf("no GitHub App key provided")
+	}
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	c.signers = signers
+	c.signer = signers[0]
+	c.signerIndex = 0
+	return c.signJWT(ctx)
+}
 
-	// sign and get the complete encoded token as a string using the secret
-	return tokenString, nil
+func (c *Client) SetGithubAppToken(token *GitHubAppToken) error {
+	if token == nil {
+		return fmt.Errorf("GitHub App Token not provided")
+	}
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	c.appToken = token
+	return nil
 }
 
-func GenerateInstallationAccessToken(token string, installationId int) (string, error) {
-	response, err := CallGithubAPI(token, "POST", fmt.Sprintf("/app/installations/%d/access_tokens", installationId), nil)
+// generate jwt token
+func GenerateToken(githubAppId string, privatePem []byte) (string, error) {
+	// parse private key
+	privateKey, err := ParsePrivateKey(privatePem, "")
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf(`error parsing private key, %v`, err)
 	}
+	return signAppJWT(context.Background(), githubAppId, NewRSASigner(privateKey))
+}
 
-	// parse the response
+func (c *Client) GenerateInstallationAccessToken(ctx context.Context, token string, installationId int, request AccessTokenRequest) (TokenInfo, error) {
 	var tokenInfo TokenInfo
-	err = json.Unmarshal([]byte(response), &tokenInfo)
-	if err != nil {
-		return "", err
-	}
-	return tokenInfo.Token, nil
+	err := c.CallGithubAPI(ctx, token, "POST", fmt.Sprintf("/app/installations/%d/access_tokens", installationId), request, &tokenInfo)
+	return tokenInfo, err
 }
 
-func GetReference(ref string) (GithubRefResponse, error) {
-	if ghAppToken == nil {
-		panic("GitHub App Token not initialized")
-	}
+func (c *Client) GetReference(ctx context.Context, ref string) (GithubRefResponse, error) {
 	var respObj GithubRefResponse
-	response, err := CallGithubAPI(ghAppToken.Token, "GET", fmt.Sprintf("/repos/%s/%s/git/%s", ghAppToken.Repo.Owner, ghAppToken.Repo.Repo, ref), nil)
-	if err != nil {
-		return respObj, err
-	}
-
-	// parse the response
-	err = json.Unmarshal([]byte(response), &respObj)
-	if err != nil {
-		return respObj, err
-	}
-	return respObj, nil
+	err := c.callRepoAPI(ctx, "GET", fmt.Sprintf("git/%s", ref), nil, &respObj)
+	return respObj, err
 }
 
-func CreateTree(tree GithubTreeRequest) (GithubTreeResponse, error) {
-	if ghAppToken == nil {
-		panic("GitHub App Token not initialized")
-	}
+func (c *Client) GetTree(ctx context.Context, sha string, recursive bool) (GithubTreeResponse, error) {
 	githubTreeResponse := GithubTreeResponse{}
-	response, err := CallGithubAPI(ghAppToken.Token, "POST", fmt.Sprintf("/repos/%s/%s/git/trees", ghAppToken.Repo.Owner, ghAppToken.Repo.Repo), tree)
-	if err != nil {
-		return githubTreeResponse, err
+	path := fmt.Sprintf("git/trees/%s", sha)
+	if recursive {
+		path = fmt.Sprintf("%s?recursive=1", path)
 	}
+	err := c.callRepoAPI(ctx, "GET", path, nil, &githubTreeResponse)
+	return githubTreeResponse, err
+}
 
-	// parse the response
-	err = json.Unmarshal([]byte(response), &githubTreeResponse)
-	if err != nil {
-		return githubTreeResponse, err
-	}
-	return githubTreeResponse, nil
+func (c *Client) CreateTree(ctx context.Context, tree GithubTreeRequest) (GithubTreeResponse, error) {
+	githubTreeResponse := GithubTreeResponse{}
+	err := c.callRepoAPI(ctx, "POST", "git/trees", tree, &githubTreeResponse)
+	return githubTreeResponse, err
 }
 
-func CreateCommit(commit GithubCommitRequest) (GithubCommitResponse, error) {
-	if ghAppToken == nil {
-		panic("GitHub App Token not initialized")
-	}
+func (c *Client) GetCommit(ctx context.Context, sha string) (GithubCommitResponse, error) {
 	var respObj GithubCommitResponse
-	response, err := CallGithubAPI(ghAppToken.Token, "POST", fmt.Sprintf("/repos/%s/%s/git/commits", ghAppToken.Repo.Owner, ghAppToken.Repo.Repo), commit)
-	if err != nil {
-		return respObj, err
-	}
+	err := c.callRepoAPI(ctx, "GET", fmt.Sprintf("git/commits/%s", sha), nil, &respObj)
+	return respObj, err
+}
 
-	// parse the response
-	err = json.Unmarshal([]byte(response), &respObj)
-	if err != nil {
-		return respObj, err
-	}
-	return respObj, nil
+func (c *Client) CreateCommit(ctx context.Context, commit GithubCommitRequest) (GithubCommitResponse, error) {
+	var respObj GithubCommitResponse
+	err := c.callRepoAPI(ctx, "POST", "git/commits", commit, &respObj)
+	return respObj, err
 }
 
-func CreateReference(request GithubRefRequest) (GithubRefResponse, error) {
-	if ghAppToken == nil {
-		panic("GitHub App Token not initialized")
-	}
+func (c *Client) CreateReference(ctx context.Context, request GithubRefRequest) (GithubRefResponse, error) {
 	var respObj GithubRefResponse
-	response, err := CallGithubAPI(ghAppToken.Token, "POST", fmt.Sprintf("/repos/%s/%s/git/refs", ghAppToken.Repo.Owner, ghAppToken.Repo.Repo), request)
-	if err != nil {
-		return respObj, err
-	}
-
-	// parse the response
-	err = json.Unmarshal([]byte(response), &respObj)
-	if err != nil {
-		return respObj, err
-	}
-	return respObj, nil
+	err := c.callRepoAPI(ctx, "POST", "git/refs", request, &respObj)
+	return respObj, err
 }
 
-func UpdateReference(request GithubRefRequest, ref string, createBranch bool) (GithubRefResponse, error) {
-	if ghAppToken == nil {
-		panic("GitHub App Token not initialized")
-	}
+func (c *Client) UpdateReference(ctx context.Context, request GithubRefRequest, ref string, createBranch bool) (GithubRefResponse, error) {
 	if createBranch {
 		// Remove "heads/" prefix if present, then add "refs/heads/"
-		branchName := ref
-		if strings.HasPrefix(ref, "heads/") {
-			branchName = ref[6:] // Remove "heads/" prefix
-		}
-		respObj, err := CreateReference(GithubRefRequest{
+		branchName := strings.TrimPrefix(ref, "heads/")
+		// Return early when creating branch - no need to update it
+		return c.CreateReference(ctx, GithubRefRequest{
 			Ref: fmt.Sprintf("refs/heads/%s", branchName),
 			Sha: request.Sha,
 		})
-		if err != nil {
-			return GithubRefResponse{}, err
-		}
-		// Return early when creating branch - no need to update it
-		return respObj, nil
 	}
 	var respObj GithubRefResponse
-	response, err := CallGithubAPI(ghAppToken.Token, "PATCH", fmt.Sprintf("/repos/%s/%s/git/refs/%s", ghAppToken.Repo.Owner, ghAppToken.Repo.Repo, ref), request)
-	if err != nil {
-		return respObj, err
-	}
-
-	// parse the response
-	err = json.Unmarshal([]byte(response), &respObj)
-	if err != nil {
-		return respObj, err
-	}
-	return respObj, nil
+	err := c.callRepoAPI(ctx, "PATCH", fmt.Sprintf("git/refs/%s", ref), request, &respObj)
+	return respObj, err
 }
 
-func CreateBlob(blob GithubBlobRequest) (GithubBlobResponse, error) {
-	if ghAppToken == nil {
-		panic("GitHub App Token not initialized")
-	}
+func (c *Client) CreateBlob(ctx context.Context, blob GithubBlobRequest) (GithubBlobResponse, error) {
 	var respObj GithubBlobResponse
-	response, err := CallGithubAPI(ghAppToken.Token, "POST", fmt.Sprintf("/repos/%s/%s/git/blobs", ghAppToken.Repo.Owner, ghAppToken.Repo.Repo), blob)
-	if err != nil {
-		return respObj, err
-	}
-
-	// parse the response
-	err = json.Unmarshal([]byte(response), &respObj)
-	if err != nil {
-		return respObj, err
-	}
-	return respObj, nil
+	err := c.callRepoAPI(ctx, "POST", "git/blobs", blob, &respObj)
+	return respObj, err
 }
 
-func CreateTag(tag GithubTagRequest) (GithubTagResponse, error) {
-	if ghAppToken == nil {
-		panic("GitHub App Token not initialized")
-	}
+func (c *Client) CreateTag(ctx context.Context, tag GithubTagRequest) (GithubTagResponse, error) {
 	var respObj GithubTagResponse
-	response, err := CallGithubAPI(ghAppToken.Token, "POST", fmt.Sprintf("/repos/%s/%s/git/tags", ghAppToken.Repo.Owner, ghAppToken.Repo.Repo), tag)
-	if err != nil {
-		return respObj, err
-	}
+	err := c.callRepoAPI(ctx, "POST", "git/tags", tag, &respObj)
+	return respObj, err
+}
 
-	// parse the response
-	err = json.Unmarshal([]byte(response), &respObj)
-	if err != nil {
-		return respObj, err
-	}
-	return respObj, nil
+func (c *Client) GetAppInstallationDetails(ctx context.Context, jwt string, repo GitHubRepo) (GithubAppInstallationResponse, error) {
+	var respObj GithubAppInstallationResponse
+	err := c.CallGithubAPI(ctx, jwt, "GET", fmt.Sprintf("/repos/%s/%s/installation", repo.Owner, repo.Repo), nil, &respObj)
+	return respObj, err
 }
 
-func GetAppInstallationDetails(jwt string, repo GitHubRepo) (GithubAppInstallationResponse, error) {
+// get the app installation of an organization, or of a user when there is no such organization
+func (c *Client) GetOwnerInstallationDetails(ctx context.Context, jwt string, owner string) (GithubAppInstallationResponse, error) {
 	var respObj GithubAppInstallationResponse
-	response, err := CallGithubAPI(jwt, "GET", fmt.Sprintf("/repos/%s/%s/installation", repo.Owner, repo.Repo), nil)
-	if err != nil {
-		return respObj, err
+	err := c.CallGithubAPI(ctx, jwt, "GET", fmt.Sprintf("/orgs/%s/installation", url.PathEscape(owner)), nil, &respObj)
+	if IsNotFound(err) {
+		err = c.CallGithubAPI(ctx, jwt, "GET", fmt.Sprintf("/users/%s/installation", url.PathEscape(owner)), nil, &respObj)
 	}
+	return respObj, err
+}
 
-	// parse the response
-	err = json.Unmarshal([]byte(response), &respObj)
+// call an endpoint of the repository the installation token was generated for
+func (c *Client) callRepoAPI(ctx context.Context, method string, path string, data interface{}, result interface{}) error {
+	appToken, err := c.installationToken(ctx)
 	if err != nil {
-		return respObj, err
+		return err
 	}
-	return respObj, nil
+	return c.CallGithubAPI(ctx, appToken.Token, method, fmt.Sprintf("/repos/%s/%s/%s", appToken.Repo.Owner, appToken.Repo.Repo, path), data, result)
 }
 
-func CallGithubAPI(token string, method string, path string, data interface{}) (string, error) {
+// call the github api and decode the json response into result, when not nil. Unsuccessful
+// responses are returned as *APIError. Rate limits, and network and server errors of requests
+// that can be repeated safely, are retried while the retry budget of the client allows it
+func (c *Client) CallGithubAPI(ctx context.Context, token string, method string, path string, data interface{}, result interface{}) error {
+	var body []byte
+	if data != nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		body = b
+	}
+
+	for attempt := 1; ; attempt++ {
+		attemptStart := time.Now()
+		b, header, err := c.sendRequest(ctx, token, method, path, body)
+		if err == nil {
+			// parse the response, some endpoints reply with 204 and no content
+			if result != nil && len(b) > 0 {
+				err = json.Unmarshal(b, result)
+				if err != nil {
+					return fmt.Errorf("error parsing github api response: %s", err)
+				}
+			}
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			// cancelled, or the overall deadline was reached
+			return err
+		}
+		delay, retry := retryDelay(err, header, attempt, isRepeatable(method, path))
+		if !retry || !c.reserveRetryBudget(time.Since(attemptStart)+delay) {
+			return err
+		}
+		fmt.Printf("GitHub API call '%s %s' failed, retrying in %s (attempt %d): %s\n", method, path, delay.Round(time.Second), attempt, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// send a single request, returning the response body and headers
+func (c *Client) sendRequest(ctx context.Context, token string, method string, path string, body []byte) ([]byte, http.Header, error) {
+	if c.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.RequestTimeout)
+		defer cancel()
+	}
+
 	// define the request
-	req, err := http.NewRequest(method, fmt.Sprintf("https://api.github.com%s", path), nil)
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s%s", c.BaseUrl, path), nil)
 	if err != nil {
-		return "", err
+		return nil, nil, err
 	}
 	req.Header.Set("Accept", "application/vnd.github+json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
 
 	// set body
-	if data != nil {
+	if body != nil {
 		req.Header.Set("Content-Type", "application/json")
-		b, err := json.Marshal(data)
-		if err != nil {
-			return "", err
-		}
-		req.Body = io.NopCloser(bytes.NewReader(b))
+		req.Body = io.NopCloser(bytes.NewReader(body))
 	}
 
 	// send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.HttpClient.Do(req)
 	if err != nil {
-		return "", err
+		return nil, nil, err
 	}
 
 	// close the response body
 	defer resp.Body.Close()
 	b, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return nil, resp.Header, err
 	}
+	c.updateRateLimit(resp.Header)
 
 	// check http status code
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return "", fmt.Errorf("error calling github api, status code: %d, response: %s", resp.StatusCode, string(b))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		apiErr := &APIError{
+			StatusCode: resp.StatusCode,
+			Response:   string(b),
+		}
+		// github returns the error message and documentation url as json, ignore other bodies
+		_ = json.Unmarshal(b, apiErr)
+		return nil, resp.Header, apiErr
 	}
-
-	return string(b), nil
+	return b, resp.Header, nil
 }
@@ -0,0 +1,34 @@
+package github_helper
+
+import "testing"
+
+func TestSetBaseUrl(t *testing.T) {
+	tests := []struct {
+		name    string
+		baseUrl string
+		want    string
+		wantErr bool
+	}{
+		{"github.com", "https://api.github.com", "https://api.github.com", false},
+		{"trailing slash", "https://api.github.com/", "https://api.github.com", false},
+		{"enterprise server without path", "https://github.example.com", "https://github.example.com/api/v3", false},
+		{"enterprise server with path", "https://github.example.com/api/v3/", "https://github.example.com/api/v3", false},
+		{"enterprise cloud data residency", "https://api.example.ghe.com", "https://api.example.ghe.com", false},
+		{"port and spaces", " http://localhost:8080 ", "http://localhost:8080/api/v3", false},
+		{"missing scheme", "github.example.com", "", true},
+		{"unsupported scheme", "ftp://github.example.com", "", true},
+		{"invalid url", "https://github.example.com/%zz", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClient("1")
+			err := c.SetBaseUrl(tt.baseUrl)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetBaseUrl(%q) error = %v, wantErr %v", tt.baseUrl, err, tt.wantErr)
+			}
+			if !tt.wantErr && c.BaseUrl != tt.want {
+				t.Errorf("SetBaseUrl(%q) = %s, want %s", tt.baseUrl, c.BaseUrl, tt.want)
+			}
+		})
+	}
+}
@@ -8,8 +8,10 @@ type GitHubRepo struct {
 }
 
 type GitHubAppToken struct {
-	Repo  GitHubRepo `json:"repo"`
-	Token string     `json:"token"`
+	Repo           GitHubRepo `json:"repo"`
+	Token          string     `json:"token"`
+	InstallationId int        `json:"installation_id"`
+	ExpiresAt      time.Time  `json:"expires_at"` // zero when unknown, the token is not refreshed then
 }
 
 type GitHubUser struct {
@@ -27,10 +29,17 @@ type Permissions struct {
 }
 
 type TokenInfo struct {
-	Token               string      `json:"token"`
-	ExpiresAt           time.Time   `json:"expires_at"`
-	Permissions         Permissions `json:"permissions"`
-	RepositorySelection string      `json:"repository_selection"`
+	Token               string            `json:"token"`
+	ExpiresAt           time.Time         `json:"expires_at"`
+	Permissions         map[string]string `json:"permissions"`
+	RepositorySelection string            `json:"repository_selection"`
+}
+
+// body of the installation token request, to restrict the token to some
+// repositories and permissions. Empty fields grant all the installation has
+type AccessTokenRequest struct {
+	Repositories []string          `json:"repositories,omitempty"`
+	Permissions  map[string]string `json:"permissions,omitempty"`
 }
 
 type RefObject struct {
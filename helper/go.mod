@@ -1,5 +1,3 @@
 module github.com/arcezd/github-app-commit-action/helper
 
-go 1.22.1
-
-require github.com/golang-jwt/jwt v3.2.2+incompatible
+go 1.24
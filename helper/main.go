@@ -1,10 +1,13 @@
 package github_helper
 
 import (
+	"context"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 type GitHubOrg struct {
@@ -22,6 +25,13 @@ type CommitOptions struct {
 	AddNewFiles        bool
 	Force              bool
 	RemoveDeletedFiles bool
+	Files              []string // paths or glob patterns to commit, all changes when empty
+	Exclude            []string // paths or glob patterns to leave out of the commit
+	StagedOnly         bool     // commit the current index as is, without staging files
+	ContentSource      string   // read file contents from the git index (default) or the working tree
+	UploadConcurrency  int      // maximum number of parallel blob uploads
+	AllowEmpty         bool     // create the commit even when it has no changes
+	PushRetries        int      // times to re-apply the changes when the branch moves while pushing
 }
 
 type GitCommit struct {
@@ -35,8 +45,10 @@ type GitCommit struct {
 
 type GitFile struct {
 	FileName   string
+	Mode       string
 	WasDeleted bool
 	Sha        *string
+	IndexSha   string // sha of the staged blob, empty when the content is read from the working tree
 }
 
 type GitTag struct {
@@ -45,7 +57,32 @@ type GitTag struct {
 	CommitSha string
 }
 
-func UploadFileToGitHubBlob(filename string) (GithubBlobResponse, error) {
+type CommitResult struct {
+	Sha           string // sha of the commit pushed, empty when nothing was committed
+	HeadSha       string // sha of the head commit after the run, the commit pushed or the unchanged head
+	Branch        string
+	Changed       bool // false when there were no changes to commit
+	BranchCreated bool
+}
+
+type TagResult struct {
+	TagName string
+	Sha     string // sha of the tag object
+	Updated bool   // the tag already existed and was moved
+}
+
+const (
+	ContentSourceIndex       = "index"
+	ContentSourceWorkingTree = "working-tree"
+)
+
+const (
+	defaultFileMode = "100644"
+	symlinkFileMode = "120000"
+	gitlinkFileMode = "160000"
+)
+
+func (c *Client) UploadFileToGitHubBlob(ctx context.Context, filename string) (GithubBlobResponse, error) {
 	resp := GithubBlobResponse{}
 	// check if file exists
 	_, err := os.Stat(filename)
@@ -65,136 +102,502 @@ func UploadFileToGitHubBlob(filename string) (GithubBlobResponse, error) {
 		if err != nil {
 			return resp, err
 		}
-		base64Content := base64.StdEncoding.EncodeToString(content)
-		req := GithubBlobRequest{
-			Content:  base64Content,
-			Encoding: "base64",
+		return c.uploadContentToGitHubBlob(ctx, content)
+	}
+}
+
+// upload the target path of a symlink as the blob content, as git does
+func (c *Client) UploadSymlinkToGitHubBlob(ctx context.Context, filename string) (GithubBlobResponse, error) {
+	target, err := os.Readlink(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Printf("Symlink '%s' was deleted: %s\n", filename, err)
+		}
+		return GithubBlobResponse{}, err
+	}
+	return c.uploadContentToGitHubBlob(ctx, []byte(target))
+}
+
+// upload the staged content of a file from the git index
+func (c *Client) UploadIndexFileToGitHubBlob(ctx context.Context, indexSha string) (GithubBlobResponse, error) {
+	content, err := ReadIndexBlob(indexSha)
+	if err != nil {
+		return GithubBlobResponse{}, err
+	}
+	return c.uploadContentToGitHubBlob(ctx, content)
+}
+
+func (c *Client) uploadContentToGitHubBlob(ctx context.Context, content []byte) (GithubBlobResponse, error) {
+	base64Content := base64.StdEncoding.EncodeToString(content)
+	req := GithubBlobRequest{
+		Content:  base64Content,
+		Encoding: "base64",
+	}
+
+	resp, err := c.CreateBlob(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+// resolve the files to commit from the staged changes. Deleted files and the old path of
+// renamed files are listed first, so moved directories are removed before being re-added
+func CollectGitFiles(changes []FileChange, contentSource string) ([]GitFile, error) {
+	deletedFiles := []GitFile{}
+	gitFiles := []GitFile{}
+
+	// paths that exist after the commit
+	files := []string{}
+	existingPaths := map[string]bool{}
+	for _, change := range changes {
+		if change.Status != "D" {
+			files = append(files, change.Path)
+			existingPaths[change.Path] = true
+		}
+	}
+
+	// read the file modes from the git index
+	indexEntries, err := GetIndexEntries(files)
+	if err != nil {
+		return gitFiles, fmt.Errorf("error reading git index: %s", err)
+	}
+
+	for _, change := range changes {
+		deletedPath := ""
+		switch change.Status {
+		case "D":
+			deletedPath = change.Path
+		case "R":
+			fmt.Printf("File '%s' was renamed to '%s'\n", change.OldPath, change.Path)
+			deletedPath = change.OldPath
+		}
+		if deletedPath != "" && !existingPaths[deletedPath] {
+			deletedFiles = append(deletedFiles, GitFile{
+				FileName:   deletedPath,
+				WasDeleted: true,
+				Sha:        nil,
+			})
+		}
+		if change.Status == "D" {
+			continue
 		}
 
-		resp, err = CreateBlob(req)
+		gitFile, err := collectGitFile(change.Path, indexEntries, contentSource)
 		if err != nil {
-			return resp, err
+			return gitFiles, err
+		}
+		if gitFile.WasDeleted {
+			deletedFiles = append(deletedFiles, gitFile)
+		} else {
+			gitFiles = append(gitFiles, gitFile)
 		}
-		return resp, nil
 	}
+	return append(deletedFiles, gitFiles...), nil
 }
 
-func UploadFilesToGitHubBlob(files []string) ([]GitFile, error) {
-	//ch := make(chan string, len(files))
-	gitFiles := []GitFile{}
-	for _, filename := range files {
-		//go func() {
-		//	res, _ := requester.Get(insrequester.RequestEntity{Endpoint: url})
-		//	ch <- fmt.Sprintf("%s: %d", url, res.StatusCode)
-		//}()
-
-		// check if file exists
-		fileBlobResp, err := UploadFileToGitHubBlob(filename)
+// resolve the mode and content location of a file from the git index, or from the working
+// tree when the content source is the working tree
+func collectGitFile(filename string, indexEntries map[string]IndexEntry, contentSource string) (GitFile, error) {
+	entry, inIndex := indexEntries[filename]
+	if inIndex && entry.Mode == gitlinkFileMode {
+		// submodule pointer, the tree entry references the submodule commit
+		fmt.Printf("Submodule '%s' points to commit %s\n", filename, entry.Sha)
+		return GitFile{
+			FileName:   filename,
+			Mode:       gitlinkFileMode,
+			WasDeleted: false,
+			Sha:        &entry.Sha,
+		}, nil
+	}
+
+	if contentSource != ContentSourceWorkingTree {
+		// the staged entry is committed, regardless of the working tree
+		if !inIndex {
+			fmt.Printf("File '%s' was removed from the index\n", filename)
+			return GitFile{
+				FileName:   filename,
+				WasDeleted: true,
+				Sha:        nil,
+			}, nil
+		}
+		return GitFile{
+			FileName:   filename,
+			Mode:       entry.Mode,
+			WasDeleted: false,
+			Sha:        nil,
+			IndexSha:   entry.Sha,
+		}, nil
+	}
+
+	// use lstat so symlinks are not followed
+	info, err := os.Lstat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Printf("File '%s' was deleted\n", filename)
+			return GitFile{
+				FileName:   filename,
+				WasDeleted: true,
+				Sha:        nil,
+			}, nil
+		}
+		return GitFile{}, fmt.Errorf("error checking if file '%s' exists: %s", filename, err)
+	}
+
+	if !inIndex && info.IsDir() {
+		// a directory that is no longer in the index is a removed submodule
+		fmt.Printf("Submodule '%s' was removed\n", filename)
+		return GitFile{
+			FileName:   filename,
+			WasDeleted: true,
+			Sha:        nil,
+		}, nil
+	}
+
+	fileMode := defaultFileMode
+	if inIndex {
+		fileMode = entry.Mode
+	} else if info.Mode()&os.ModeSymlink != 0 {
+		fileMode = symlinkFileMode
+	}
+	return GitFile{
+		FileName:   filename,
+		Mode:       fileMode,
+		WasDeleted: false,
+		Sha:        nil,
+	}, nil
+}
+
+// drop the files whose content and mode match the base tree, and the deletion of paths that
+// don't exist in it, so only the actual changes are uploaded and committed
+func FilterUnchangedFiles(files []GitFile, baseTree GithubTreeResponse) ([]GitFile, error) {
+	if baseTree.Truncated {
+		fmt.Println("Base tree is too large to be compared, all files will be uploaded")
+		return files, nil
+	}
+	baseEntries := map[string]TreeItem{}
+	for _, item := range baseTree.Tree {
+		baseEntries[item.Path] = item
+	}
+
+	changedFiles := []GitFile{}
+	for _, file := range files {
+		baseEntry, inBase := baseEntries[file.FileName]
+		if file.WasDeleted {
+			if inBase {
+				changedFiles = append(changedFiles, file)
+			} else {
+				fmt.Printf("File '%s' doesn't exist in the base tree, skipping\n", file.FileName)
+			}
+			continue
+		}
+		if !inBase || baseEntry.Sha == nil || baseEntry.Mode != file.Mode {
+			changedFiles = append(changedFiles, file)
+			continue
+		}
+
+		sha, err := localBlobSha(file)
 		if err != nil {
 			if os.IsNotExist(err) {
-				gitFiles = append(gitFiles, GitFile{
-					FileName:   filename,
-					WasDeleted: true,
-					Sha:        nil,
-				})
-			} else {
-				return gitFiles, fmt.Errorf("error uploading file '%s' to GitHub: %s", filename, err)
+				// handled when uploading the file
+				changedFiles = append(changedFiles, file)
+				continue
 			}
-		} else {
-			gitFiles = append(gitFiles, GitFile{
-				FileName:   filename,
-				WasDeleted: false,
-				Sha:        &fileBlobResp.Sha,
-			})
+			return changedFiles, fmt.Errorf("error hashing file '%s': %s", file.FileName, err)
+		}
+		if sha == *baseEntry.Sha {
+			fmt.Printf("File '%s' is unchanged, skipping\n", file.FileName)
+			continue
 		}
+		changedFiles = append(changedFiles, file)
 	}
-	return gitFiles, nil
+	return changedFiles, nil
 }
 
-func SignJWTAppToken(appId string, privatePem []byte) {
-	initAppToken(appId, privatePem)
+// sha of the object that will be committed for a file
+func localBlobSha(file GitFile) (string, error) {
+	if file.Mode == gitlinkFileMode && file.Sha != nil {
+		return *file.Sha, nil
+	}
+	if file.IndexSha != "" {
+		return file.IndexSha, nil
+	}
+
+	var content []byte
+	if file.Mode == symlinkFileMode {
+		target, err := os.Readlink(file.FileName)
+		if err != nil {
+			return "", err
+		}
+		content = []byte(target)
+	} else {
+		fileContent, err := os.ReadFile(file.FileName)
+		if err != nil {
+			return "", err
+		}
+		content = fileContent
+	}
+	return GitBlobSha(content), nil
+}
+
+// get the full tree of a commit
+func (c *Client) getCommitTree(ctx context.Context, commitSha string) (GithubTreeResponse, error) {
+	commitResp, err := c.GetCommit(ctx, commitSha)
+	if err != nil {
+		return GithubTreeResponse{}, err
+	}
+	if commitResp.Tree.Sha == nil {
+		return GithubTreeResponse{}, fmt.Errorf("commit '%s' has no tree", commitSha)
+	}
+	return c.GetTree(ctx, *commitResp.Tree.Sha, true)
 }
 
-func SignJWTAppTokenWithFilename(appId string, pemFilename string) {
-	if pemFilename == "" {
-		panic("PEM file not provided")
+// upload the files to github blobs using up to 'concurrency' parallel uploads. The result keeps
+// the order of the files, and the remaining uploads are cancelled after the first error
+func (c *Client) UploadFilesToGitHubBlob(ctx context.Context, files []GitFile, concurrency int) ([]GitFile, error) {
+	if concurrency < 1 {
+		concurrency = 1
 	}
+	gitFiles := make([]GitFile, len(files))
+	copy(gitFiles, files)
 
-	// read the private key from a file
-	privatePem, err := os.ReadFile(pemFilename)
+	// cancelled on the first error, aborting the uploads in progress
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	jobs := make(chan int)
+
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				// skip the remaining files after an error
+				if ctx.Err() != nil {
+					continue
+				}
+
+				gitFile, err := c.uploadGitFile(ctx, gitFiles[i])
+				if err != nil {
+					cancel(err)
+					continue
+				}
+				gitFiles[i] = gitFile
+			}
+		}()
+	}
+
+sendJobs:
+	for i := range gitFiles {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break sendJobs
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return gitFiles, context.Cause(ctx)
+	}
+	return gitFiles, nil
+}
+
+func (c *Client) uploadGitFile(ctx context.Context, file GitFile) (GitFile, error) {
+	// deleted files and submodules don't need a blob
+	if file.WasDeleted || file.Mode == gitlinkFileMode {
+		return file, nil
+	}
+
+	var fileBlobResp GithubBlobResponse
+	var err error
+	if file.IndexSha != "" {
+		fileBlobResp, err = c.UploadIndexFileToGitHubBlob(ctx, file.IndexSha)
+	} else if file.Mode == symlinkFileMode {
+		fileBlobResp, err = c.UploadSymlinkToGitHubBlob(ctx, file.FileName)
+	} else {
+		fileBlobResp, err = c.UploadFileToGitHubBlob(ctx, file.FileName)
+	}
 	if err != nil {
-		panic(err)
+		if os.IsNotExist(err) {
+			file.WasDeleted = true
+			file.Sha = nil
+			return file, nil
+		}
+		return file, fmt.Errorf("error uploading file '%s' to GitHub: %w", file.FileName, err)
 	}
-	SignJWTAppToken(appId, privatePem)
+	file.Sha = &fileBlobResp.Sha
+	return file, nil
 }
 
-func GenerateInstallationAppToken(repo GitHubRepo) GitHubAppToken {
-	// get app installation details
-	app, err := GetAppInstallationDetails(ghAppSignedToken, repo)
+// sign the app jwt with the private keys of the pem files, tried in order
+func (c *Client) SignJWTAppTokenWithFilenames(ctx context.Context, pemFilenames []string, passphrase string) error {
+	if len(pemFilenames) == 0 {
+		return fmt.Errorf("PEM file not provided")
+	}
+
+	signers := []Signer{}
+	for _, pemFilename := range pemFilenames {
+		// read the private key from a file
+		privatePem, err := os.ReadFile(pemFilename)
+		if err != nil {
+			return fmt.Errorf("error reading private key file '%s': %w", pemFilename, err)
+		}
+		privateKeys, err := ParsePrivateKeys(privatePem, passphrase)
+		if err != nil {
+			return fmt.Errorf("error reading private key file '%s': %w", pemFilename, err)
+		}
+		for _, privateKey := range privateKeys {
+			signers = append(signers, NewRSASigner(privateKey))
+		}
+	}
+	return c.SetSigners(ctx, signers...)
+}
+
+// generate the installation token, trying the app keys in order until GitHub accepts one
+func (c *Client) GenerateInstallationAppToken(ctx context.Context, repo GitHubRepo) (GitHubAppToken, error) {
+	signers := c.appSigners()
+	for i := range signers {
+		// a previous call may have left a later key in use
+		signer, err := c.useSigner(ctx, i)
+		if err != nil {
+			return GitHubAppToken{}, err
+		}
+
+		token, err := c.generateInstallationAppToken(ctx, repo)
+		if err == nil && signerFingerprint(signer) != "" {
+			fmt.Printf("Installation token generated with the app key %s\n", signerFingerprint(signer))
+		}
+		if err == nil {
+			return token, nil
+		}
+		if !IsUnauthorized(err) || i == len(signers)-1 {
+			return GitHubAppToken{}, err
+		}
+		fmt.Printf("The app key %s was rejected by GitHub, trying the next key\n", signerFingerprint(signer))
+	}
+	return c.generateInstallationAppToken(ctx, repo)
+}
+
+func (c *Client) generateInstallationAppToken(ctx context.Context, repo GitHubRepo) (GitHubAppToken, error) {
+	signedToken, err := c.appJWT(ctx)
 	if err != nil {
-		panic(err)
+		return GitHubAppToken{}, err
+	}
+
+	installationId, err := c.findInstallationId(ctx, signedToken, repo)
+	if err != nil {
+		return GitHubAppToken{}, err
 	}
 
 	// generate installation app token
-	installationToken, err := GenerateInstallationAccessToken(ghAppSignedToken, app.Id)
+	tokenInfo, err := c.GenerateInstallationAccessToken(ctx, signedToken, installationId, c.accessTokenRequest(repo))
 	if err != nil {
-		panic(err)
+		return GitHubAppToken{}, fmt.Errorf("error generating the installation token: %w", err)
 	}
+	fmt.Printf("Installation token permissions: %s\n", FormatPermissions(tokenInfo.Permissions))
 	return GitHubAppToken{
-		Repo:  repo,
-		Token: installationToken,
+		Repo:           repo,
+		Token:          tokenInfo.Token,
+		InstallationId: installationId,
+		ExpiresAt:      tokenInfo.ExpiresAt,
+	}, nil
+}
+
+// the configured installation id, or the installation of the owner or the repository
+func (c *Client) findInstallationId(ctx context.Context, signedToken string, repo GitHubRepo) (int, error) {
+	if c.InstallationId != 0 {
+		return c.InstallationId, nil
+	}
+
+	// get app installation details
+	if c.InstallationOwner != "" {
+		app, err := c.GetOwnerInstallationDetails(ctx, signedToken, c.InstallationOwner)
+		if err != nil {
+			return 0, fmt.Errorf("error getting the app installation for '%s': %w", c.InstallationOwner, err)
+		}
+		return app.Id, nil
+	}
+	app, err := c.GetAppInstallationDetails(ctx, signedToken, repo)
+	if err != nil {
+		return 0, fmt.Errorf("error getting the app installation for '%s/%s': %w", repo.Owner, repo.Repo, err)
 	}
+	return app.Id, nil
 }
 
-func CommitAndPush(repo GitHubRepo, commit GitCommit) string {
+// commit the local changes to a branch of repo, the repository of the installation token
+func (c *Client) CommitAndPush(ctx context.Context, repo GitHubRepo, commit GitCommit) (CommitResult, error) {
+	result := CommitResult{
+		Branch: commit.Branch,
+	}
+
+	// the repository calls use the installation token, restricted to the repository it was generated for
+	appToken, err := c.installationToken(ctx)
+	if err != nil {
+		return result, err
+	}
+	if !strings.EqualFold(appToken.Repo.Owner, repo.Owner) || !strings.EqualFold(appToken.Repo.Repo, repo.Repo) {
+		return result, fmt.Errorf("the installation token was generated for repository '%s/%s', not '%s/%s'", appToken.Repo.Owner, appToken.Repo.Repo, repo.Owner, repo.Repo)
+	}
+
 	// get head reference
 	if commit.HeadBranch == nil {
 		commit.HeadBranch = &commit.Branch
 	}
-	githubRefResponse, err := GetReference(fmt.Sprintf("refs/heads/%s", *commit.HeadBranch))
+	githubRefResponse, err := c.GetReference(ctx, fmt.Sprintf("refs/heads/%s", *commit.HeadBranch))
 	if err != nil {
-		panic(err)
+		return result, fmt.Errorf("error reading head branch '%s': %w", *commit.HeadBranch, err)
 	}
 
 	// get files to commit
-	var files []string
-	if commit.Options.AddNewFiles {
-		files, err = GetModifiedAndNewFiles()
+	pathspecs := BuildPathspecs(commit.Options.Files, commit.Options.Exclude)
+	var changes []FileChange
+	if commit.Options.StagedOnly {
+		changes, err = GetModifiedFilesFromGitDiff(true, pathspecs...)
+	} else if commit.Options.AddNewFiles {
+		changes, err = GetModifiedAndNewFiles(pathspecs...)
 	} else {
-		files, err = GetModifiedFiles()
+		changes, err = GetModifiedFiles(pathspecs...)
 	}
 	if err != nil {
-		panic(err)
+		return result, fmt.Errorf("error listing changed files: %w", err)
 	}
 
-	// upload files to github blobs
-	gitFiles, err := UploadFilesToGitHubBlob(files)
+	// resolve deleted and renamed files and file modes (regular, executable, symlink or submodule)
+	gitFiles, err := CollectGitFiles(changes, commit.Options.ContentSource)
 	if err != nil {
-		panic(err)
+		return result, err
 	}
 
-	// create git tree
-	treeFiles := []TreeItem{}
-	for _, file := range gitFiles {
-		treeFiles = append(treeFiles, TreeItem{
-			Path: file.FileName,
-			Mode: "100644",
-			Type: "blob",
-			Sha:  file.Sha,
-		})
+	// skip the files that are unchanged in the base tree
+	baseTree, err := c.getCommitTree(ctx, githubRefResponse.Object.Sha)
+	if err != nil {
+		return result, fmt.Errorf("error reading the tree of '%s': %w", githubRefResponse.Object.Sha, err)
 	}
-	treeReq := GithubTreeRequest{
-		BaseTree: githubRefResponse.Object.Sha,
-		Tree:     treeFiles,
+	gitFiles, err = FilterUnchangedFiles(gitFiles, baseTree)
+	if err != nil {
+		return result, err
 	}
-	b, err := json.Marshal(treeReq)
+	if len(gitFiles) == 0 && !commit.Options.AllowEmpty {
+		return skipEmptyCommit(result, githubRefResponse.Object.Sha)
+	}
+
+	// upload files to github blobs
+	gitFiles, err = c.UploadFilesToGitHubBlob(ctx, gitFiles, commit.Options.UploadConcurrency)
 	if err != nil {
-		panic(err)
+		return result, err
 	}
-	fmt.Println(string(b))
-	treeResp, err := CreateTree(treeReq)
+
+	// create git tree, an empty commit reuses the base tree
+	parentSha := githubRefResponse.Object.Sha
+	treeSha, err := c.createGitTree(ctx, gitFiles, parentSha, baseTree.Sha)
 	if err != nil {
-		panic(err)
+		return result, fmt.Errorf("error creating the tree: %w", err)
+	}
+	if treeSha == baseTree.Sha && !commit.Options.AllowEmpty {
+		return skipEmptyCommit(result, parentSha)
 	}
 
 	// add coauthors and on-behalf-of to commit message
@@ -211,52 +614,200 @@ func CommitAndPush(repo GitHubRepo, commit GitCommit) string {
 		}
 	}
 
-	// create commit
-	commitReq := GithubCommitRequest{
-		Message: commitMessage,
-		Tree:    treeResp.Sha,
-		Parents: []string{
-			githubRefResponse.Object.Sha,
-		},
+	var refResp GithubRefResponse
+	for attempt := 0; ; attempt++ {
+		// create commit
+		commitReq := GithubCommitRequest{
+			Message: commitMessage,
+			Tree:    treeSha,
+			Parents: []string{
+				parentSha,
+			},
+		}
+		commitResp, err := c.CreateCommit(ctx, commitReq)
+		if err != nil {
+			return result, fmt.Errorf("error creating the commit: %w", err)
+		}
+
+		// update git reference
+		refReq := GithubRefRequest{
+			Sha: commitResp.Sha,
+		}
+		// force push if required
+		if commit.Options.Force {
+			refReq.Force = true
+		}
+
+		// don't move the branch once cancelled
+		if ctx.Err() != nil {
+			return result, fmt.Errorf("branch '%s' was not updated: %w", commit.Branch, context.Cause(ctx))
+		}
+
+		// try to update the branch first (most common case)
+		refResp, err = c.UpdateReference(ctx, refReq, fmt.Sprintf("heads/%s", commit.Branch), false)
+		if err == nil {
+			fmt.Printf("Target branch '%s' updated.\n", commit.Branch)
+			break
+		}
+		if IsReferenceNotFound(err) {
+			fmt.Printf("Target branch '%s' doesn't exist. Creating it.\n", commit.Branch)
+			refResp, err = c.UpdateReference(ctx, refReq, fmt.Sprintf("heads/%s", commit.Branch), true)
+			if err != nil {
+				return result, fmt.Errorf("error creating branch '%s': %w", commit.Branch, err)
+			}
+			result.BranchCreated = true
+			break
+		}
+		switch {
+		case IsProtectedBranch(err):
+			return result, fmt.Errorf("branch '%s' is protected and the GitHub App is not allowed to push to it: %w", commit.Branch, err)
+		case IsPermissionDenied(err):
+			return result, fmt.Errorf("the GitHub App is not allowed to update branch '%s', check it has 'contents: write' permission: %w", commit.Branch, err)
+		case IsNotFound(err):
+			return result, fmt.Errorf("the GitHub App can't access repository '%s/%s' to update branch '%s', check it is installed on the repository: %w", repo.Owner, repo.Repo, commit.Branch, err)
+		case !IsNonFastForward(err):
+			return result, fmt.Errorf("error updating branch '%s': %w", commit.Branch, err)
+		}
+		if attempt >= commit.Options.PushRetries {
+			return result, fmt.Errorf("%w: branch '%s' kept moving, giving up after %d retries: %w", ErrConflict, commit.Branch, attempt, err)
+		}
+
+		// the branch moved since it was read, re-apply the changes on top of the new head
+		headRefResponse, err := c.GetReference(ctx, fmt.Sprintf("refs/heads/%s", *commit.HeadBranch))
+		if err != nil {
+			return result, fmt.Errorf("error reading head branch '%s': %w", *commit.HeadBranch, err)
+		}
+		if headRefResponse.Object.Sha == parentSha {
+			return result, fmt.Errorf("%w: branch '%s' is not a fast forward of head branch '%s'. Use force push to overwrite it", ErrConflict, commit.Branch, *commit.HeadBranch)
+		}
+		fmt.Printf("Branch '%s' moved to '%s', retrying (%d/%d)\n", *commit.HeadBranch, headRefResponse.Object.Sha, attempt+1, commit.Options.PushRetries)
+		newBaseTree, err := c.getCommitTree(ctx, headRefResponse.Object.Sha)
+		if err != nil {
+			return result, fmt.Errorf("error reading the tree of '%s': %w", headRefResponse.Object.Sha, err)
+		}
+		conflicts, err := findConflictingFiles(gitFiles, baseTree, newBaseTree)
+		if err != nil {
+			return result, fmt.Errorf("%w: %w", ErrConflict, err)
+		}
+		if len(conflicts) > 0 {
+			return result, fmt.Errorf("%w: branch '%s' was updated with changes to the same files: %s", ErrConflict, *commit.HeadBranch, strings.Join(conflicts, ", "))
+		}
+
+		parentSha = headRefResponse.Object.Sha
+		baseTree = newBaseTree
+		treeSha, err = c.createGitTree(ctx, gitFiles, parentSha, baseTree.Sha)
+		if err != nil {
+			return result, fmt.Errorf("error creating the tree: %w", err)
+		}
+		if treeSha == baseTree.Sha && !commit.Options.AllowEmpty {
+			// the same changes were already pushed
+			return skipEmptyCommit(result, parentSha)
+		}
+	}
+
+	result.Sha = refResp.Object.Sha
+	result.HeadSha = result.Sha
+	result.Changed = true
+	message := fmt.Sprintf("Commit '%s' pushed to branch '%s' with SHA '%s'\n", commit.Message, commit.Branch, result.Sha)
+	return result, publishCommitResult(result, message)
+}
+
+// create the git tree with the files on top of the base commit. Returns the base tree sha when
+// there are no files
+func (c *Client) createGitTree(ctx context.Context, gitFiles []GitFile, baseCommitSha string, baseTreeSha string) (string, error) {
+	if len(gitFiles) == 0 {
+		return baseTreeSha, nil
+	}
+
+	treeFiles := []TreeItem{}
+	for _, file := range gitFiles {
+		fileMode := file.Mode
+		if fileMode == "" {
+			fileMode = defaultFileMode
+		}
+		fileType := "blob"
+		if fileMode == gitlinkFileMode {
+			fileType = "commit"
+		}
+		treeFiles = append(treeFiles, TreeItem{
+			Path: file.FileName,
+			Mode: fileMode,
+			Type: fileType,
+			Sha:  file.Sha,
+		})
 	}
-	commitResp, err := CreateCommit(commitReq)
+	treeReq := GithubTreeRequest{
+		BaseTree: baseCommitSha,
+		Tree:     treeFiles,
+	}
+	treeResp, err := c.CreateTree(ctx, treeReq)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
+	return treeResp.Sha, nil
+}
 
-	// update git reference
-	refReq := GithubRefRequest{
-		Sha: commitResp.Sha,
+// list the files that changed between the old and the new base tree
+func findConflictingFiles(gitFiles []GitFile, oldTree GithubTreeResponse, newTree GithubTreeResponse) ([]string, error) {
+	if oldTree.Truncated || newTree.Truncated {
+		return nil, fmt.Errorf("base tree is too large to check for conflicting changes")
 	}
-	// force push if required
-	if commit.Options.Force {
-		refReq.Force = true
+	oldEntries := map[string]TreeItem{}
+	for _, item := range oldTree.Tree {
+		oldEntries[item.Path] = item
 	}
-	
-	// try to update the branch first (most common case)
-	refResp, err := UpdateReference(refReq, fmt.Sprintf("heads/%s", commit.Branch), false)
-	if err != nil {
-		// if update failed, try creating the branch
-		fmt.Printf("Target branch '%s' doesn't exist. Creating it.\n", commit.Branch)
-		refResp, err = UpdateReference(refReq, fmt.Sprintf("heads/%s", commit.Branch), true)
-	} else {
-		fmt.Printf("Target branch '%s' updated.\n", commit.Branch)
+	newEntries := map[string]TreeItem{}
+	for _, item := range newTree.Tree {
+		newEntries[item.Path] = item
 	}
-	if err != nil {
-		panic(err)
+
+	conflicts := []string{}
+	for _, file := range gitFiles {
+		oldEntry, inOld := oldEntries[file.FileName]
+		newEntry, inNew := newEntries[file.FileName]
+		if inOld != inNew {
+			conflicts = append(conflicts, file.FileName)
+			continue
+		}
+		if inOld && (oldEntry.Mode != newEntry.Mode || oldEntry.Sha == nil || newEntry.Sha == nil || *oldEntry.Sha != *newEntry.Sha) {
+			conflicts = append(conflicts, file.FileName)
+		}
 	}
+	return conflicts, nil
+}
+
+// report that there is nothing to commit, without creating a commit
+func skipEmptyCommit(result CommitResult, headSha string) (CommitResult, error) {
+	result.HeadSha = headSha
+	result.Changed = false
+	message := fmt.Sprintf("No changes to commit, branch '%s' was not updated\n", result.Branch)
+	return result, publishCommitResult(result, message)
+}
 
-	message := fmt.Sprintf("Commit '%s' pushed to branch '%s' with SHA '%s'\n", commit.Message, commit.Branch, refResp.Object.Sha)
+// print the message, add it to the step summary and set the step outputs
+func publishCommitResult(result CommitResult, message string) error {
 	fmt.Print(message)
-	AppendToGHActionsSummary(message)
+	err := AppendToGHActionsSummary(message)
+	if err != nil {
+		return err
+	}
 
-	SendToGHActionsOutput("sha", refResp.Object.Sha)
-	return refResp.Object.Sha
+	if result.Sha != "" {
+		err = SendToGHActionsOutput("sha", result.Sha)
+		if err != nil {
+			return err
+		}
+	}
+	return SendToGHActionsOutput("changed", strconv.FormatBool(result.Changed))
 }
 
-func CreateTagAndPush(tag GitTag) {
+func (c *Client) CreateTagAndPush(ctx context.Context, tag GitTag) (TagResult, error) {
+	result := TagResult{
+		TagName: tag.TagName,
+	}
+
 	// create tag
-	tagResp, err := CreateTag(GithubTagRequest{
+	tagResp, err := c.CreateTag(ctx, GithubTagRequest{
 		Tag:     tag.TagName,
 		Message: tag.Message,
 		Object:  tag.CommitSha,
@@ -264,30 +815,41 @@ func CreateTagAndPush(tag GitTag) {
 		Tagger:  nil,
 	})
 	if err != nil {
-		panic(err)
+		return result, fmt.Errorf("error creating tag '%s': %w", tag.TagName, err)
 	}
+	result.Sha = tagResp.Sha
 
 	// check if tag already exists
-	_, err = GetReference(fmt.Sprintf("refs/tags/%s", tag.TagName))
+	_, err = c.GetReference(ctx, fmt.Sprintf("refs/tags/%s", tag.TagName))
+	if err != nil && !IsNotFound(err) {
+		return result, fmt.Errorf("error reading tag '%s': %w", tag.TagName, err)
+	}
+
+	var message string
 	if err == nil {
 		// tag already exists
 		fmt.Printf("Tag '%s' already exists. Updating\n", tag.TagName)
-		UpdateReference(GithubRefRequest{
+		_, err = c.UpdateReference(ctx, GithubRefRequest{
 			Sha:   tagResp.Sha,
 			Force: true,
 		}, fmt.Sprintf("tags/%s", tag.TagName), false)
-		message := fmt.Sprintf("Tag '%s' updated with Sha %s\n", tag.TagName, tagResp.Sha)
-		fmt.Print(message)
-		AppendToGHActionsSummary(message)
+		if err != nil {
+			return result, fmt.Errorf("error updating tag '%s': %w", tag.TagName, err)
+		}
+		result.Updated = true
+		message = fmt.Sprintf("Tag '%s' updated with Sha %s\n", tag.TagName, tagResp.Sha)
 	} else {
 		// create tag reference
-		CreateReference(GithubRefRequest{
+		_, err = c.CreateReference(ctx, GithubRefRequest{
 			Ref:   fmt.Sprintf("refs/tags/%s", tag.TagName),
 			Sha:   tagResp.Sha,
 			Force: true,
 		})
-		message := fmt.Sprintf("Tag '%s' with Sha %s created\n", tag.TagName, tagResp.Sha)
-		fmt.Print(message)
-		AppendToGHActionsSummary(message)
+		if err != nil {
+			return result, fmt.Errorf("error creating tag reference '%s': %w", tag.TagName, err)
+		}
+		message = fmt.Sprintf("Tag '%s' with Sha %s created\n", tag.TagName, tagResp.Sha)
 	}
+	fmt.Print(message)
+	return result, AppendToGHActionsSummary(message)
 }
@@ -0,0 +1,417 @@
+package github_helper
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func treeItem(path string, mode string, sha string) TreeItem {
+	return TreeItem{Path: path, Mode: mode, Type: "blob", Sha: &sha}
+}
+
+func fileNames(files []GitFile) []string {
+	names := []string{}
+	for _, file := range files {
+		names = append(names, file.FileName)
+	}
+	return names
+}
+
+func TestFilterUnchangedFiles(t *testing.T) {
+	initTestRepo(t)
+	writeTestFile(t, "same.txt", "hello\n")
+	writeTestFile(t, "changed.txt", "new content\n")
+	writeTestFile(t, "mode.sh", "hello\n")
+	helloSha := "ce013625030ba8dba906f756967f9e9ca394464a"
+
+	baseTree := GithubTreeResponse{
+		Tree: []TreeItem{
+			treeItem("same.txt", defaultFileMode, helloSha),
+			treeItem("changed.txt", defaultFileMode, helloSha),
+			treeItem("mode.sh", defaultFileMode, helloSha),
+			treeItem("deleted.txt", defaultFileMode, helloSha),
+			treeItem("indexed.txt", defaultFileMode, helloSha),
+			treeItem("missing.txt", defaultFileMode, helloSha),
+		},
+	}
+	files := []GitFile{
+		{FileName: "same.txt", Mode: defaultFileMode},
+		{FileName: "changed.txt", Mode: defaultFileMode},
+		{FileName: "mode.sh", Mode: "100755"},
+		{FileName: "new.txt", Mode: defaultFileMode},
+		{FileName: "deleted.txt", WasDeleted: true},
+		{FileName: "never-existed.txt", WasDeleted: true},
+		{FileName: "indexed.txt", Mode: defaultFileMode, IndexSha: helloSha},
+		{FileName: "missing.txt", Mode: defaultFileMode},
+	}
+
+	tests := []struct {
+		name     string
+		baseTree GithubTreeResponse
+		want     []string
+	}{
+		{
+			name:     "compare with base tree",
+			baseTree: baseTree,
+			want:     []string{"changed.txt", "mode.sh", "new.txt", "deleted.txt", "missing.txt"},
+		},
+		{
+			name:     "truncated base tree",
+			baseTree: GithubTreeResponse{Truncated: true},
+			want:     fileNames(files),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FilterUnchangedFiles(files, tt.baseTree)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(fileNames(got), tt.want) {
+				t.Errorf("FilterUnchangedFiles() = %v, want %v", fileNames(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestFindConflictingFiles(t *testing.T) {
+	oldTree := GithubTreeResponse{
+		Tree: []TreeItem{
+			treeItem("untouched.txt", defaultFileMode, "aaa"),
+			treeItem("edited.txt", defaultFileMode, "bbb"),
+			treeItem("chmod.sh", defaultFileMode, "ccc"),
+			treeItem("removed.txt", defaultFileMode, "ddd"),
+			treeItem("other.txt", defaultFileMode, "eee"),
+		},
+	}
+	newTree := GithubTreeResponse{
+		Tree: []TreeItem{
+			treeItem("untouched.txt", defaultFileMode, "aaa"),
+			treeItem("edited.txt", defaultFileMode, "bbb2"),
+			treeItem("chmod.sh", "100755", "ccc"),
+			treeItem("added.txt", defaultFileMode, "fff"),
+			treeItem("other.txt", defaultFileMode, "eee2"),
+		},
+	}
+
+	tests := []struct {
+		name    string
+		files   []string
+		oldTree GithubTreeResponse
+		newTree GithubTreeResponse
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "no conflicts",
+			files:   []string{"untouched.txt", "brand-new.txt"},
+			oldTree: oldTree,
+			newTree: newTree,
+			want:    []string{},
+		},
+		{
+			name:    "conflicts",
+			files:   []string{"untouched.txt", "edited.txt", "chmod.sh", "removed.txt", "added.txt"},
+			oldTree: oldTree,
+			newTree: newTree,
+			want:    []string{"edited.txt", "chmod.sh", "removed.txt", "added.txt"},
+		},
+		{
+			name:    "truncated tree",
+			files:   []string{"untouched.txt"},
+			oldTree: oldTree,
+			newTree: GithubTreeResponse{Truncated: true},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := []GitFile{}
+			for _, name := range tt.files {
+				files = append(files, GitFile{FileName: name, Mode: defaultFileMode})
+			}
+			got, err := findConflictingFiles(files, tt.oldTree, tt.newTree)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findConflictingFiles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// verify the RS256 signature of the app jwt in the Authorization header
+func jwtSignedBy(r *http.Request, key *rsa.PublicKey) bool {
+	jwt := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	dot := strings.LastIndex(jwt, ".")
+	if dot < 0 {
+		return false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(jwt[dot+1:])
+	if err != nil {
+		return false
+	}
+	digest := sha256.Sum256([]byte(jwt[:dot]))
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+}
+
+func TestGenerateInstallationAppTokenKeyRotation(t *testing.T) {
+	oldKey, err := ParsePrivateKey([]byte(readTestKey(t, "pkcs1.pem")), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	accepted := &newKey.PublicKey
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method != http.MethodPost || r.URL.Path != "/app/installations/42/access_tokens" {
+			http.NotFound(w, r)
+			return
+		}
+		if !jwtSignedBy(r, accepted) {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"message":"A JSON web token could not be decoded"}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"token":"token","expires_at":"` + time.Now().Add(time.Hour).Format(time.RFC3339) + `"}`))
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	c := NewClient("1")
+	c.BaseUrl = server.URL
+	c.InstallationId = 42
+	err = c.SetSigners(ctx, NewRSASigner(oldKey), NewRSASigner(newKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := GitHubRepo{Owner: "owner", Repo: "repo"}
+
+	// the first key was rotated out, the second one is accepted
+	_, err = c.GenerateInstallationAppToken(ctx, repo)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.KeyFingerprint() != KeyFingerprint(&newKey.PublicKey) {
+		t.Errorf("fingerprint = %s, want the second key %s", c.KeyFingerprint(), KeyFingerprint(&newKey.PublicKey))
+	}
+
+	// a later call starts again from the first key
+	mu.Lock()
+	accepted = &oldKey.PublicKey
+	mu.Unlock()
+	_, err = c.GenerateInstallationAppToken(ctx, repo)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.KeyFingerprint() != KeyFingerprint(&oldKey.PublicKey) {
+		t.Errorf("fingerprint = %s, want the first key %s", c.KeyFingerprint(), KeyFingerprint(&oldKey.PublicKey))
+	}
+}
+
+// fake blob api answering with 'sha-<content>', the handler decides how each upload goes
+func newBlobServer(t *testing.T, handle func(w http.ResponseWriter, r *http.Request, content string)) *Client {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/repos/owner/repo/git/blobs" {
+			http.NotFound(w, r)
+			return
+		}
+		var blob GithubBlobRequest
+		err := json.NewDecoder(r.Body).Decode(&blob)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		content, err := base64.StdEncoding.DecodeString(blob.Content)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		handle(w, r, string(content))
+	}))
+	t.Cleanup(server.Close)
+
+	c := NewClient("1")
+	c.BaseUrl = server.URL
+	err := c.SetGithubAppToken(&GitHubAppToken{Repo: GitHubRepo{Owner: "owner", Repo: "repo"}, Token: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestUploadFilesToGitHubBlob(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	t.Run("keeps the order of the files", func(t *testing.T) {
+		files := []GitFile{}
+		for i := range 12 {
+			name := fmt.Sprintf("file%02d.txt", i)
+			writeTestFile(t, name, name)
+			files = append(files, GitFile{FileName: name, Mode: defaultFileMode})
+		}
+		c := newBlobServer(t, func(w http.ResponseWriter, r *http.Request, content string) {
+			// the first files finish last
+			var i int
+			_, _ = fmt.Sscanf(content, "file%02d.txt", &i)
+			time.Sleep(time.Duration(12-i) * 5 * time.Millisecond)
+			_, _ = w.Write([]byte(`{"sha":"sha-` + content + `"}`))
+		})
+
+		got, err := c.UploadFilesToGitHubBlob(context.Background(), files, 4)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(fileNames(got), fileNames(files)) {
+			t.Fatalf("files = %v, want %v", fileNames(got), fileNames(files))
+		}
+		for _, file := range got {
+			if file.Sha == nil || *file.Sha != "sha-"+file.FileName {
+				t.Errorf("file %s has sha %v, want sha-%s", file.FileName, file.Sha, file.FileName)
+			}
+		}
+	})
+
+	t.Run("stops after the first error", func(t *testing.T) {
+		files := []GitFile{}
+		writeTestFile(t, "fail.txt", "fail")
+		files = append(files, GitFile{FileName: "fail.txt", Mode: defaultFileMode})
+		for i := range 12 {
+			name := fmt.Sprintf("slow%02d.txt", i)
+			writeTestFile(t, name, name)
+			files = append(files, GitFile{FileName: name, Mode: defaultFileMode})
+		}
+		var mu sync.Mutex
+		started := 0
+		c := newBlobServer(t, func(w http.ResponseWriter, r *http.Request, content string) {
+			mu.Lock()
+			started++
+			mu.Unlock()
+			if content == "fail" {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				_, _ = w.Write([]byte(`{"message":"Invalid request"}`))
+				return
+			}
+			// the other uploads are still running when the first one fails
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+				_, _ = w.Write([]byte(`{"sha":"sha-` + content + `"}`))
+			}
+		})
+
+		const concurrency = 4
+		_, err := c.UploadFilesToGitHubBlob(context.Background(), files, concurrency)
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnprocessableEntity || !strings.Contains(err.Error(), "fail.txt") {
+			t.Fatalf("error = %v, want the upload error of fail.txt", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if started > concurrency {
+			t.Errorf("%d uploads started, want at most %d", started, concurrency)
+		}
+	})
+}
+
+func TestFindInstallationId(t *testing.T) {
+	responses := map[string]string{
+		"/orgs/acme/installation":        `{"id":11}`,
+		"/users/alice/installation":      `{"id":12}`,
+		"/repos/owner/repo/installation": `{"id":13}`,
+	}
+	tests := []struct {
+		name           string
+		installationId int
+		owner          string
+		want           int
+		wantRequests   []string
+		wantErr        bool
+	}{
+		{name: "installation id", installationId: 7, owner: "acme", want: 7, wantRequests: []string{}},
+		{name: "organization", owner: "acme", want: 11, wantRequests: []string{"/orgs/acme/installation"}},
+		{name: "user", owner: "alice", want: 12, wantRequests: []string{"/orgs/alice/installation", "/users/alice/installation"}},
+		{name: "unknown owner", owner: "nobody", wantRequests: []string{"/orgs/nobody/installation", "/users/nobody/installation"}, wantErr: true},
+		{name: "forbidden organization", owner: "forbidden", wantRequests: []string{"/orgs/forbidden/installation"}, wantErr: true},
+		{name: "repository", want: 13, wantRequests: []string{"/repos/owner/repo/installation"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			requests := []string{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				requests = append(requests, r.URL.Path)
+				mu.Unlock()
+				if r.URL.Path == "/orgs/forbidden/installation" {
+					w.WriteHeader(http.StatusForbidden)
+					_, _ = w.Write([]byte(`{"message":"Forbidden"}`))
+					return
+				}
+				response, ok := responses[r.URL.Path]
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					_, _ = w.Write([]byte(`{"message":"Not Found"}`))
+					return
+				}
+				_, _ = w.Write([]byte(response))
+			}))
+			defer server.Close()
+
+			c := NewClient("1")
+			c.BaseUrl = server.URL
+			c.InstallationId = tt.installationId
+			c.InstallationOwner = tt.owner
+			got, err := c.findInstallationId(context.Background(), "jwt", GitHubRepo{Owner: "owner", Repo: "repo"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("installation id = %d, want %d", got, tt.want)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(requests, tt.wantRequests) {
+				t.Errorf("requests = %v, want %v", requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestCommitAndPushOtherRepository(t *testing.T) {
+	c := NewClient("1")
+	// no api call is expected
+	c.BaseUrl = "http://127.0.0.1:0"
+	err := c.SetGithubAppToken(&GitHubAppToken{Repo: GitHubRepo{Owner: "owner", Repo: "repo"}, Token: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.CommitAndPush(context.Background(), GitHubRepo{Owner: "owner", Repo: "other"}, GitCommit{Branch: "main"})
+	if err == nil || !strings.Contains(err.Error(), "'owner/repo', not 'owner/other'") {
+		t.Fatalf("error = %v, want an error about the token repository", err)
+	}
+}
@@ -0,0 +1,127 @@
+package github_helper
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RateLimit struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+const (
+	DefaultRetryBudget    = 2 * time.Minute
+	DefaultRequestTimeout = time.Minute
+	minRetryDelay         = time.Second
+	maxRetryDelay         = 30 * time.Second
+	// github asks to wait at least one minute after hitting a secondary rate limit
+	secondaryRateLimitDelay = time.Minute
+	// log the rate limit when the remaining requests go below this value
+	lowRateLimitRemaining = 100
+)
+
+// last rate limit reported by github, the limit is zero when it wasn't reported yet
+func (c *Client) RateLimit() RateLimit {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rateLimit
+}
+
+func (c *Client) updateRateLimit(header http.Header) {
+	limit, err := strconv.Atoi(header.Get("X-RateLimit-Limit"))
+	if err != nil {
+		return
+	}
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, _ := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wasLow := c.rateLimit.Limit > 0 && c.rateLimit.Remaining < lowRateLimitRemaining
+	c.rateLimit = RateLimit{
+		Limit:     limit,
+		Remaining: remaining,
+		Reset:     time.Unix(reset, 0),
+	}
+	if remaining < lowRateLimitRemaining && !wasLow {
+		fmt.Printf("GitHub API rate limit is running low: %d of %d requests remaining, resets at %s\n", remaining, limit, c.rateLimit.Reset.Format(time.RFC3339))
+	}
+}
+
+// take the time of a failed attempt and the delay before its retry from the retry budget,
+// shared by all the calls so parallel uploads can't each spend the whole budget. Returns
+// false when they don't fit in what is left
+func (c *Client) reserveRetryBudget(spent time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.retrySpent+spent > c.RetryBudget {
+		return false
+	}
+	c.retrySpent += spent
+	return true
+}
+
+// whether sending the request twice has the same effect as sending it once. Git objects are
+// content addressed, creating one again returns the same object. Tokens and references are
+// not: a request may have succeeded before its response was lost
+func isRepeatable(method string, path string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	case http.MethodPost:
+		for _, suffix := range []string{"/git/blobs", "/git/trees", "/git/commits", "/git/tags"} {
+			if strings.HasSuffix(path, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// how long to wait before retrying a failed request, and whether it should be retried at all.
+// Network and server errors are only retried for repeatable requests, rate limited requests
+// were not processed
+func retryDelay(err error, header http.Header, attempt int, repeatable bool) (time.Duration, bool) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		// network error
+		return backoffDelay(attempt), repeatable
+	}
+
+	switch {
+	case apiErr.StatusCode >= http.StatusInternalServerError:
+		return backoffDelay(attempt), repeatable
+	case apiErr.StatusCode == http.StatusForbidden || apiErr.StatusCode == http.StatusTooManyRequests:
+		if seconds, err := strconv.Atoi(header.Get("Retry-After")); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if header.Get("X-RateLimit-Remaining") == "0" {
+			if reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+				return max(time.Until(time.Unix(reset, 0)), minRetryDelay), true
+			}
+		}
+		if hasMessage(err, "secondary rate limit") {
+			return secondaryRateLimitDelay, true
+		}
+		if apiErr.StatusCode == http.StatusTooManyRequests {
+			return backoffDelay(attempt), true
+		}
+	}
+	// other errors, like permissions or validation errors, won't succeed on retry
+	return 0, false
+}
+
+// exponential backoff, starting at one second
+func backoffDelay(attempt int) time.Duration {
+	delay := minRetryDelay << min(attempt-1, 5)
+	return min(delay, maxRetryDelay)
+}
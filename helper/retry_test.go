@@ -0,0 +1,192 @@
+package github_helper
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{5, 16 * time.Second},
+		{6, 30 * time.Second},
+		{20, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		got := backoffDelay(tt.attempt)
+		if got != tt.want {
+			t.Errorf("backoffDelay(%d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	reset := strconv.FormatInt(time.Now().Add(10*time.Second).Unix(), 10)
+	tests := []struct {
+		name          string
+		err           error
+		header        http.Header
+		attempt       int
+		notRepeatable bool
+		wantDelay     time.Duration
+		wantRetry     bool
+		tolerance     time.Duration
+	}{
+		{
+			name:      "network error",
+			err:       errors.New("connection reset by peer"),
+			attempt:   2,
+			wantDelay: 2 * time.Second,
+			wantRetry: true,
+		},
+		{
+			name:      "server error",
+			err:       &APIError{StatusCode: http.StatusBadGateway},
+			attempt:   1,
+			wantDelay: time.Second,
+			wantRetry: true,
+		},
+		{
+			name:      "retry after",
+			err:       &APIError{StatusCode: http.StatusTooManyRequests},
+			header:    http.Header{"Retry-After": []string{"7"}},
+			attempt:   1,
+			wantDelay: 7 * time.Second,
+			wantRetry: true,
+		},
+		{
+			name:      "primary rate limit",
+			err:       &APIError{StatusCode: http.StatusForbidden, Message: "API rate limit exceeded"},
+			header:    http.Header{"X-Ratelimit-Remaining": []string{"0"}, "X-Ratelimit-Reset": []string{reset}},
+			attempt:   1,
+			wantDelay: 10 * time.Second,
+			wantRetry: true,
+			tolerance: 2 * time.Second,
+		},
+		{
+			name:      "secondary rate limit",
+			err:       &APIError{StatusCode: http.StatusForbidden, Message: "You have exceeded a secondary rate limit"},
+			attempt:   1,
+			wantDelay: secondaryRateLimitDelay,
+			wantRetry: true,
+		},
+		{
+			name:      "too many requests without headers",
+			err:       &APIError{StatusCode: http.StatusTooManyRequests},
+			attempt:   3,
+			wantDelay: 4 * time.Second,
+			wantRetry: true,
+		},
+		{
+			name:          "network error, not repeatable",
+			err:           errors.New("connection reset by peer"),
+			attempt:       1,
+			notRepeatable: true,
+			wantDelay:     time.Second,
+		},
+		{
+			name:          "server error, not repeatable",
+			err:           &APIError{StatusCode: http.StatusBadGateway},
+			attempt:       1,
+			notRepeatable: true,
+			wantDelay:     time.Second,
+		},
+		{
+			name:          "retry after, not repeatable",
+			err:           &APIError{StatusCode: http.StatusTooManyRequests},
+			header:        http.Header{"Retry-After": []string{"7"}},
+			attempt:       1,
+			notRepeatable: true,
+			wantDelay:     7 * time.Second,
+			wantRetry:     true,
+		},
+		{
+			name:    "permission denied",
+			err:     &APIError{StatusCode: http.StatusForbidden, Message: "Resource not accessible by integration"},
+			attempt: 1,
+		},
+		{
+			name:    "validation error",
+			err:     &APIError{StatusCode: http.StatusUnprocessableEntity},
+			attempt: 1,
+		},
+		{
+			name:    "not found",
+			err:     &APIError{StatusCode: http.StatusNotFound},
+			attempt: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := tt.header
+			if header == nil {
+				header = http.Header{}
+			}
+			delay, retry := retryDelay(tt.err, header, tt.attempt, !tt.notRepeatable)
+			if retry != tt.wantRetry {
+				t.Fatalf("retry = %v, want %v", retry, tt.wantRetry)
+			}
+			if !retry {
+				return
+			}
+			diff := delay - tt.wantDelay
+			if diff < -tt.tolerance || diff > tt.tolerance {
+				t.Errorf("delay = %s, want %s", delay, tt.wantDelay)
+			}
+		})
+	}
+}
+
+func TestIsRepeatable(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   bool
+	}{
+		{"GET", "/repos/owner/repo/git/ref/heads/main", true},
+		{"DELETE", "/installation/token", true},
+		{"POST", "/repos/owner/repo/git/blobs", true},
+		{"POST", "/repos/owner/repo/git/trees", true},
+		{"POST", "/repos/owner/repo/git/commits", true},
+		{"POST", "/repos/owner/repo/git/tags", true},
+		{"POST", "/repos/owner/repo/git/refs", false},
+		{"PATCH", "/repos/owner/repo/git/refs/heads/main", false},
+		{"POST", "/app/installations/42/access_tokens", false},
+	}
+	for _, tt := range tests {
+		got := isRepeatable(tt.method, tt.path)
+		if got != tt.want {
+			t.Errorf("isRepeatable(%s, %s) = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestReserveRetryBudget(t *testing.T) {
+	c := NewClient("1")
+	c.RetryBudget = 10 * time.Second
+
+	steps := []struct {
+		spent time.Duration
+		want  bool
+	}{
+		{4 * time.Second, true},
+		{4 * time.Second, true},
+		{4 * time.Second, false},
+		{2 * time.Second, true},
+		{time.Millisecond, false},
+	}
+	for i, step := range steps {
+		got := c.reserveRetryBudget(step.spent)
+		if got != step.want {
+			t.Errorf("step %d: reserveRetryBudget(%s) = %v, want %v", i, step.spent, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package github_helper
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Signer signs the app jwt with RS256, RSASSA-PKCS1-v1_5 with SHA-256, so the
+// private key can be held outside the process, e.g. in a KMS or HSM
+type Signer interface {
+	// sign the jwt signing input, '<header>.<claims>', and return the raw signature
+	Sign(ctx context.Context, signingInput []byte) ([]byte, error)
+}
+
+// signers that can identify their key, to report which key GitHub accepted
+type fingerprinter interface {
+	Fingerprint() string
+}
+
+// RSASigner signs with a private key held in memory
+type RSASigner struct {
+	Key *rsa.PrivateKey
+}
+
+// CommandSigner pipes the signing input to the stdin of an external command and
+// reads the signature from its stdout, either raw or base64 encoded
+type CommandSigner struct {
+	Path    string
+	Args    []string
+	Timeout time.Duration // no timeout when zero
+}
+
+const (
+	// timeout of the signing command, it usually calls a remote KMS
+	DefaultSignerTimeout = 30 * time.Second
+	signerWaitDelay      = time.Second
+)
+
+func NewRSASigner(key *rsa.PrivateKey) *RSASigner {
+	return &RSASigner{Key: key}
+}
+
+func (s *RSASigner) Sign(ctx context.Context, signingInput []byte) ([]byte, error) {
+	digest := sha256.Sum256(signingInput)
+	return rsa.SignPKCS1v15(rand.Reader, s.Key, crypto.SHA256, digest[:])
+}
+
+// SHA256 fingerprint of the key, as shown in the GitHub App settings
+func (s *RSASigner) Fingerprint() string {
+	return KeyFingerprint(&s.Key.PublicKey)
+}
+
+// NewShellCommandSigner returns a signer running command with 'sh -c', so it can
+// use pipes, e.g. to decode the output of a KMS cli
+func NewShellCommandSigner(command string) *CommandSigner {
+	return &CommandSigner{
+		Path:    "sh",
+		Args:    []string{"-c", command},
+		Timeout: DefaultSignerTimeout,
+	}
+}
+
+// Sign runs the command, which is killed when ctx is cancelled or after the timeout
+func (s *CommandSigner) Sign(ctx context.Context, signingInput []byte) ([]byte, error) {
+	cmdCtx := ctx
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		cmdCtx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(cmdCtx, s.Path, s.Args...) // #nosec G204 -- the signing command is configured by the user
+	cmd.Stdin = bytes.NewReader(signingInput)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// only the shell is killed, don't wait for the commands of its pipeline holding stdout
+	cmd.WaitDelay = signerWaitDelay
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("jwt signing command cancelled: %w", ctx.Err())
+	}
+	if cmdCtx.Err() != nil {
+		return nil, fmt.Errorf("jwt signing command timed out after %s", s.Timeout)
+	}
+	if err != nil && stderr.Len() > 0 {
+		return nil, fmt.Errorf("jwt signing command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("jwt signing command failed: %w", err)
+	}
+	if stderr.Len() > 0 {
+		fmt.Fprintf(os.Stderr, "jwt signing command: %s\n", strings.TrimSpace(stderr.String()))
+	}
+	return decodeSignature(stdout.Bytes())
+}
+
+// decode a signature printed in base64, with or without padding, or returned as raw bytes
+func decodeSignature(output []byte) ([]byte, error) {
+	text := strings.TrimSpace(string(output))
+	if text == "" {
+		return nil, fmt.Errorf("jwt signing command returned an empty signature")
+	}
+	// hex is also valid base64, e.g. the 512 hex digits of a 2048 bit signature decode to 384 bytes
+	if isHexSignature(text) {
+		return nil, fmt.Errorf("jwt signing command returned a hex encoded signature, print it raw or base64 encoded, e.g. with 'xxd -r -p | base64'")
+	}
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		signature, err := encoding.DecodeString(text)
+		if err == nil && isRSASignatureSize(len(signature)) {
+			return signature, nil
+		}
+	}
+	if isRSASignatureSize(len(output)) {
+		return output, nil
+	}
+	return nil, fmt.Errorf("jwt signing command returned %d bytes, expected a 2048, 3072 or 4096 bit RSA signature, raw or base64 encoded", len(output))
+}
+
+// the signature is as long as the key modulus
+func isRSASignatureSize(size int) bool {
+	return size == 256 || size == 384 || size == 512
+}
+
+func isHexSignature(text string) bool {
+	if !isRSASignatureSize(len(text) / 2) {
+		return false
+	}
+	_, err := hex.DecodeString(text)
+	return err == nil
+}
+
+// fingerprint of the signer key, empty when the signer doesn't know it, e.g. a command signer
+func signerFingerprint(signer Signer) string {
+	if f, ok := signer.(fingerprinter); ok {
+		return f.Fingerprint()
+	}
+	return ""
+}
+
+// build the RS256 app jwt, issued in the past in case the clock is ahead of github's
+func signAppJWT(ctx context.Context, githubAppId string, signer Signer) (string, error) {
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-jwtClockSkew).Unix(),
+		"exp": now.Add(jwtTTL).Unix(),
+		"iss": githubAppId,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	signature, err := signer.Sign(ctx, []byte(signingInput))
+	if err != nil {
+		return "", fmt.Errorf(`error signing jwt token, %w`, err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
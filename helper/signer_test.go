@@ -0,0 +1,79 @@
+package github_helper
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeSignature(t *testing.T) {
+	signature := bytes.Repeat([]byte{0xfb, 0xff, 0x01}, 128)[:256]
+	tests := []struct {
+		name    string
+		output  []byte
+		wantErr bool
+	}{
+		{name: "raw", output: signature},
+		{name: "base64", output: []byte(base64.StdEncoding.EncodeToString(signature) + "\n")},
+		{name: "base64 without padding", output: []byte(base64.RawStdEncoding.EncodeToString(signature))},
+		{name: "base64url", output: []byte(base64.URLEncoding.EncodeToString(signature))},
+		{name: "wrapped base64", output: []byte(base64.StdEncoding.EncodeToString(signature)[:76] + "\n" + base64.StdEncoding.EncodeToString(signature)[76:] + "\n")},
+		{name: "hex", output: []byte(hex.EncodeToString(signature) + "\n"), wantErr: true},
+		{name: "short raw", output: signature[:100], wantErr: true},
+		{name: "short base64", output: []byte(base64.StdEncoding.EncodeToString(signature[:128])), wantErr: true},
+		{name: "error message", output: []byte("error: key not found\n"), wantErr: true},
+		{name: "empty", output: []byte(" \n"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeSignature(tt.output)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(got, signature) {
+				t.Errorf("decoded signature differs from the signature")
+			}
+		})
+	}
+}
+
+func TestCommandSignerStops(t *testing.T) {
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		signer := NewShellCommandSigner("sleep 10")
+		_, err := signer.Sign(ctx, []byte("input"))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+	t.Run("timeout", func(t *testing.T) {
+		signer := NewShellCommandSigner("sleep 10")
+		signer.Timeout = 100 * time.Millisecond
+		_, err := signer.Sign(context.Background(), []byte("input"))
+		if err == nil || !strings.Contains(err.Error(), "timed out") {
+			t.Fatalf("error = %v, want a timeout", err)
+		}
+	})
+}
+
+func TestSignerFingerprint(t *testing.T) {
+	key, err := ParsePrivateKey([]byte(readTestKey(t, "pkcs1.pem")), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := signerFingerprint(NewRSASigner(key))
+	if got != KeyFingerprint(&key.PublicKey) || !strings.HasPrefix(got, "SHA256:") {
+		t.Errorf("rsa signer fingerprint = %q, want %q", got, KeyFingerprint(&key.PublicKey))
+	}
+	// the key of a command signer is unknown, the key-fingerprint output is left empty
+	got = signerFingerprint(NewShellCommandSigner("cat"))
+	if got != "" {
+		t.Errorf("command signer fingerprint = %q, want empty", got)
+	}
+}
@@ -0,0 +1,184 @@
+package github_helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// github rejects jwts issued in the future, so they are backdated to allow some clock skew
+	jwtClockSkew = time.Minute
+	// sign a new jwt when the current one expires within this margin
+	jwtRefreshMargin = 30 * time.Second
+	// generate a new installation token when the current one expires within this margin
+	tokenRefreshMargin = 5 * time.Minute
+)
+
+var (
+	jwtTTL = time.Duration(TOKEN_TTL) * time.Minute
+)
+
+// sign the app jwt with the signer. The caller holds tokenMu
+func (c *Client) signJWT(ctx context.Context) error {
+	expiresAt := time.Now().Add(jwtTTL)
+	token, err := signAppJWT(ctx, c.appId, c.signer)
+	if err != nil {
+		return err
+	}
+	c.signedToken = token
+	c.jwtExpiresAt = expiresAt
+	return nil
+}
+
+// switch to the signer at index, e.g. the next one after GitHub rejected the jwt of the
+// current one. The jwt is signed again only when the signer changes
+func (c *Client) useSigner(ctx context.Context, index int) (Signer, error) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	signer := c.signers[index]
+	if index == c.signerIndex {
+		return signer, nil
+	}
+	c.signer = signer
+	c.signerIndex = index
+	return signer, c.signJWT(ctx)
+}
+
+// the app key signers, tried in order
+func (c *Client) appSigners() []Signer {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	return c.signers
+}
+
+// SHA256 fingerprint of the app key in use, empty when the signer doesn't know the key
+func (c *Client) KeyFingerprint() string {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	if c.signer == nil {
+		return ""
+	}
+	return signerFingerprint(c.signer)
+}
+
+// the app jwt, signed again when it is about to expire
+func (c *Client) appJWT(ctx context.Context) (string, error) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	return c.currentJWT(ctx)
+}
+
+// the caller holds tokenMu
+func (c *Client) currentJWT(ctx context.Context) (string, error) {
+	if c.signer == nil {
+		return "", fmt.Errorf("GitHub App JWT not signed, a private key or signer is required")
+	}
+	if time.Until(c.jwtExpiresAt) < jwtRefreshMargin {
+		err := c.signJWT(ctx)
+		if err != nil {
+			return "", err
+		}
+	}
+	return c.signedToken, nil
+}
+
+// the installation token, generated again when it is about to expire
+func (c *Client) installationToken(ctx context.Context) (GitHubAppToken, error) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	if c.appToken == nil {
+		return GitHubAppToken{}, ErrTokenNotInitialized
+	}
+
+	// tokens without expiration or installation can't be refreshed
+	canRefresh := !c.appToken.ExpiresAt.IsZero() && c.appToken.InstallationId != 0 && c.signer != nil
+	if !canRefresh || time.Until(c.appToken.ExpiresAt) > tokenRefreshMargin {
+		return *c.appToken, nil
+	}
+
+	fmt.Printf("Installation token expires at %s, generating a new one\n", c.appToken.ExpiresAt.Format(time.RFC3339))
+	signedToken, err := c.currentJWT(ctx)
+	if err != nil {
+		return GitHubAppToken{}, err
+	}
+	tokenInfo, err := c.GenerateInstallationAccessToken(ctx, signedToken, c.appToken.InstallationId, c.accessTokenRequest(c.appToken.Repo))
+	if err != nil {
+		return GitHubAppToken{}, fmt.Errorf("error refreshing the installation token: %w", err)
+	}
+	// calls that read the replaced token before the refresh may still be using it, it
+	// is revoked with the current one when the run ends
+	c.replacedTokens = append(c.replacedTokens, *c.appToken)
+	c.appToken.Token = tokenInfo.Token
+	c.appToken.ExpiresAt = tokenInfo.ExpiresAt
+	return *c.appToken, nil
+}
+
+// RevokeInstallationToken revokes the installation token and the tokens it replaced when
+// it was refreshed, so they can't be used after the run even if they leaked. The client
+// has no installation token afterwards
+func (c *Client) RevokeInstallationToken(ctx context.Context) error {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+
+	var errs []error
+	for _, token := range c.replacedTokens {
+		// expired tokens can't be used anymore, and github rejects them
+		if time.Now().After(token.ExpiresAt) {
+			continue
+		}
+		err := c.CallGithubAPI(ctx, token.Token, "DELETE", "/installation/token", nil, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error revoking a replaced installation token: %w", err))
+		}
+	}
+	c.replacedTokens = nil
+
+	if c.appToken != nil {
+		err := c.CallGithubAPI(ctx, c.appToken.Token, "DELETE", "/installation/token", nil, nil)
+		if err != nil {
+			return errors.Join(append(errs, fmt.Errorf("error revoking the installation token: %w", err))...)
+		}
+		c.appToken = nil
+	}
+	return errors.Join(errs...)
+}
+
+// restrict the installation token to the repository and the configured permissions
+func (c *Client) accessTokenRequest(repo GitHubRepo) AccessTokenRequest {
+	return AccessTokenRequest{
+		Repositories: []string{repo.Repo},
+		Permissions:  c.TokenPermissions,
+	}
+}
+
+// parse permissions in the format 'contents:write, workflows:write'
+func ParsePermissions(permissions []string) (map[string]string, error) {
+	result := map[string]string{}
+	for _, permission := range permissions {
+		name, level, found := strings.Cut(permission, ":")
+		name = strings.TrimSpace(name)
+		level = strings.TrimSpace(level)
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid token permission '%s', expected format is 'name:level'", permission)
+		}
+		if level != "read" && level != "write" && level != "admin" {
+			return nil, fmt.Errorf("invalid level '%s' for token permission '%s', expected 'read', 'write' or 'admin'", level, name)
+		}
+		result[name] = level
+	}
+	return result, nil
+}
+
+// format permissions as 'name:level' sorted by name
+func FormatPermissions(permissions map[string]string) string {
+	formatted := make([]string, 0, len(permissions))
+	for name, level := range permissions {
+		formatted = append(formatted, fmt.Sprintf("%s:%s", name, level))
+	}
+	sort.Strings(formatted)
+	return strings.Join(formatted, ", ")
+}
@@ -0,0 +1,137 @@
+package github_helper
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParsePermissions(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions []string
+		want        map[string]string
+		wantErr     bool
+	}{
+		{"none", nil, map[string]string{}, false},
+		{"default", []string{"contents:write"}, map[string]string{"contents": "write"}, false},
+		{
+			name:        "several with spaces",
+			permissions: []string{" contents : write", "workflows:write", "pull_requests:read"},
+			want:        map[string]string{"contents": "write", "workflows": "write", "pull_requests": "read"},
+		},
+		{"last one wins", []string{"contents:read", "contents:write"}, map[string]string{"contents": "write"}, false},
+		{"missing level", []string{"contents"}, nil, true},
+		{"missing name", []string{":write"}, nil, true},
+		{"invalid level", []string{"contents:none"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePermissions(tt.permissions)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePermissions(%v) error = %v, wantErr %v", tt.permissions, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParsePermissions(%v) = %v, want %v", tt.permissions, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatPermissions(t *testing.T) {
+	got := FormatPermissions(map[string]string{"workflows": "write", "contents": "write", "metadata": "read"})
+	want := "contents:write, metadata:read, workflows:write"
+	if got != want {
+		t.Errorf("FormatPermissions() = %s, want %s", got, want)
+	}
+}
+
+func TestInstallationTokenRefresh(t *testing.T) {
+	key, err := ParsePrivateKey([]byte(readTestKey(t, "pkcs1.pem")), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	refreshes := 0
+	revoked := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/app/installations/42/access_tokens":
+			refreshes++
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"token":"new","expires_at":"` + time.Now().Add(time.Hour).Format(time.RFC3339) + `"}`))
+		case r.Method == http.MethodDelete && r.URL.Path == "/installation/token":
+			revoked = append(revoked, r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet && r.URL.Path == "/repos/owner/repo/git/ref/heads/main":
+			for _, token := range revoked {
+				if token == r.Header.Get("Authorization") {
+					w.WriteHeader(http.StatusUnauthorized)
+					_, _ = w.Write([]byte(`{"message":"Bad credentials"}`))
+					return
+				}
+			}
+			_, _ = w.Write([]byte(`{"ref":"refs/heads/main","object":{"sha":"abc","type":"commit"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	c := NewClient("1")
+	c.BaseUrl = server.URL
+	err = c.SetSigner(ctx, NewRSASigner(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// within the refresh margin, the first call refreshes it
+	err = c.SetGithubAppToken(&GitHubAppToken{Repo: GitHubRepo{Owner: "owner", Repo: "repo"}, Token: "old", InstallationId: 42, ExpiresAt: time.Now().Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// parallel calls around the refresh, like the upload workers
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = c.GetReference(ctx, "ref/heads/main")
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("call %d: unexpected error: %v", i, err)
+		}
+	}
+	if refreshes != 1 {
+		t.Errorf("refreshes = %d, want 1", refreshes)
+	}
+
+	// a call that read the token before the refresh can still use it
+	err = c.CallGithubAPI(ctx, "old", "GET", "/repos/owner/repo/git/ref/heads/main", nil, nil)
+	if err != nil {
+		t.Errorf("replaced token rejected before the end of the run: %v", err)
+	}
+	if len(revoked) > 0 {
+		t.Errorf("revoked = %v before the end of the run, want none", revoked)
+	}
+
+	err = c.RevokeInstallationToken(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error revoking the tokens: %v", err)
+	}
+	want := []string{"Bearer old", "Bearer new"}
+	if !reflect.DeepEqual(revoked, want) {
+		t.Errorf("revoked = %v, want %v", revoked, want)
+	}
+}
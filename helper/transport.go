@@ -0,0 +1,72 @@
+package github_helper
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+type TransportOptions struct {
+	ProxyUrl       string // proxy for every request, the HTTPS_PROXY and NO_PROXY env variables are used when empty
+	CABundleFile   string // pem file with CA certificates trusted in addition to the system ones
+	ClientCertFile string // pem client certificate for mutual TLS
+	ClientKeyFile  string // pem private key of the client certificate
+}
+
+// NewTransport returns the http transport with the proxy, CA bundle and client certificate settings
+func NewTransport(options TransportOptions) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if options.ProxyUrl != "" {
+		proxyUrl, err := url.Parse(options.ProxyUrl)
+		if err != nil || proxyUrl.Host == "" {
+			return nil, fmt.Errorf("invalid proxy url '%s'", options.ProxyUrl)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if options.CABundleFile != "" {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		caBundle, err := os.ReadFile(options.CABundleFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA bundle '%s': %w", options.CABundleFile, err)
+		}
+		if !rootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no certificates found in CA bundle '%s'", options.CABundleFile)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	if options.ClientCertFile != "" || options.ClientKeyFile != "" {
+		if options.ClientCertFile == "" || options.ClientKeyFile == "" {
+			return nil, fmt.Errorf("both the client certificate and the client key are required")
+		}
+		clientCert, err := tls.LoadX509KeyPair(options.ClientCertFile, options.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate '%s': %w", options.ClientCertFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// use a transport with the given options for all the client api calls
+func (c *Client) ConfigureTransport(options TransportOptions) error {
+	transport, err := NewTransport(options)
+	if err != nil {
+		return err
+	}
+	c.HttpClient = &http.Client{
+		Transport: transport,
+	}
+	return nil
+}
@@ -2,8 +2,9 @@ package github_helper
 
 import (
 	"bytes"
+	"crypto/sha1" // #nosec G505 -- git object ids are sha1 hashes
+	"encoding/hex"
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
 	"regexp"
@@ -22,6 +23,23 @@ type FileInfo struct {
 	Name        string
 }
 
+type FileChange struct {
+	Status  string // Can be one of: A (added), M (modified), D (deleted), R (renamed), C (copied), T (type changed)
+	Path    string
+	OldPath string // previous path of renamed and copied files
+}
+
+type IndexEntry struct {
+	Path string
+	Mode string // Can be one of: 100644, 100755, 160000, 120000
+	Sha  string
+}
+
+const (
+	// pathspec magic of the exclude patterns
+	excludePathspecMagic = ":(exclude)"
+)
+
 func ListFiles(dir *string) ([]FileInfo, error) {
 	output, err := executeCommand("ls", "-al")
 	if err != nil {
@@ -53,73 +71,200 @@ func ListFiles(dir *string) ([]FileInfo, error) {
 	return files, nil
 }
 
-func StageModifiedAndNewFiles() error {
-	_, err := executeCommand("git", "add", "-A")
+func StageModifiedAndNewFiles(pathspecs ...string) error {
+	return stageFiles("-A", pathspecs)
+}
+
+func StageModifiedFiles(pathspecs ...string) error {
+	return stageFiles("-u", pathspecs)
+}
+
+// stage the changes of the pathspecs with 'git add <mode>'. Pathspecs without changes
+// are left out, git fails when one of them doesn't match any file
+func stageFiles(mode string, pathspecs []string) error {
+	pathspecs, ok, err := pathspecsWithChanges(mode, pathspecs)
+	if err != nil || !ok {
+		return err
+	}
+	cmdArgs := append([]string{"add", mode, "--"}, pathspecs...)
+	_, err = executeCommand("git", cmdArgs...)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func StageModifiedFiles() error {
-	_, err := executeCommand("git", "add", "-u")
-	if err != nil {
-		return err
+// keep the exclude pathspecs and the pathspecs with changes to stage. ok is false when
+// none of the pathspecs to include has changes, there is nothing to stage then
+func pathspecsWithChanges(mode string, pathspecs []string) ([]string, bool, error) {
+	result := []string{}
+	includes := 0
+	for _, pathspec := range pathspecs {
+		if strings.HasPrefix(pathspec, excludePathspecMagic) {
+			result = append(result, pathspec)
+			continue
+		}
+		output, err := executeCommand("git", "add", "--dry-run", "--ignore-missing", mode, "--", pathspec)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(bytes.TrimSpace(output)) == 0 {
+			fmt.Printf("No changes match '%s'\n", pathspec)
+			continue
+		}
+		result = append(result, pathspec)
+		includes++
 	}
-	return nil
+	if len(pathspecs) > 0 && includes == 0 {
+		return nil, false, nil
+	}
+	return result, true, nil
 }
 
-func GetModifiedAndNewFiles() ([]string, error) {
-	var modfiles []string
-	err := StageModifiedAndNewFiles()
+func GetModifiedAndNewFiles(pathspecs ...string) ([]FileChange, error) {
+	var modfiles []FileChange
+	err := StageModifiedAndNewFiles(pathspecs...)
 	if err != nil {
 		return modfiles, err
 	}
-	return GetModifiedFilesFromGitDiff(true)
+	return GetModifiedFilesFromGitDiff(true, pathspecs...)
 }
 
-func GetModifiedFiles() ([]string, error) {
-	var modfiles []string
-	err := StageModifiedFiles()
+func GetModifiedFiles(pathspecs ...string) ([]FileChange, error) {
+	var modfiles []FileChange
+	err := StageModifiedFiles(pathspecs...)
 	if err != nil {
 		return modfiles, err
 	}
-	return GetModifiedFilesFromGitDiff(true)
+	return GetModifiedFilesFromGitDiff(true, pathspecs...)
 }
 
-func GetModifiedFilesFromGitDiff(fromStaged bool) ([]string, error) {
-	var modfiles []string
-	cmdArgs := []string{"diff", "--name-only"}
+func GetModifiedFilesFromGitDiff(fromStaged bool, pathspecs ...string) ([]FileChange, error) {
+	var modfiles []FileChange
+	// detect renames explicitly so the result doesn't depend on the 'diff.renames' config
+	cmdArgs := []string{"diff", "--name-status", "-z", "-M"}
 	if fromStaged {
 		cmdArgs = append(cmdArgs, "--cached")
 	}
+	cmdArgs = append(cmdArgs, "--")
+	cmdArgs = append(cmdArgs, pathspecs...)
 	cmd := exec.Command("git", cmdArgs...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		fmt.Printf("Error during 'GetModifiedFilesFromGitDiff' - Path %s - :%s\n", cmd.Dir, err)
 		return modfiles, err
 	}
+	return parseNameStatus(string(output))
+}
+
+// BuildPathspecs returns the git pathspecs that select the given files, excluding the exclude
+// patterns. Both accept paths and glob patterns. An empty list selects the whole working tree.
+func BuildPathspecs(files []string, exclude []string) []string {
+	pathspecs := append([]string{}, files...)
+	if len(exclude) > 0 && len(pathspecs) == 0 {
+		// exclude patterns need something to be excluded from
+		pathspecs = append(pathspecs, ".")
+	}
+	for _, pattern := range exclude {
+		pathspecs = append(pathspecs, excludePathspecMagic+pattern)
+	}
+	return pathspecs
+}
+
+// parse the output of 'git diff --name-status -z', where each entry has the format
+// '<status>\0<path>\0' or '<status><score>\0<old path>\0<new path>\0' for renames and copies
+func parseNameStatus(output string) ([]FileChange, error) {
+	var changes []FileChange
+	fields := strings.Split(output, "\x00")
+	for i := 0; i < len(fields); i++ {
+		if fields[i] == "" {
+			continue
+		}
+		status := fields[i][:1]
+		switch status {
+		case "R", "C":
+			if i+2 >= len(fields) {
+				return changes, fmt.Errorf("unexpected 'git diff' output for status '%s'", fields[i])
+			}
+			changes = append(changes, FileChange{
+				Status:  status,
+				OldPath: fields[i+1],
+				Path:    fields[i+2],
+			})
+			i += 2
+		default:
+			if i+1 >= len(fields) {
+				return changes, fmt.Errorf("unexpected 'git diff' output for status '%s'", fields[i])
+			}
+			changes = append(changes, FileChange{
+				Status: status,
+				Path:   fields[i+1],
+			})
+			i++
+		}
+	}
+	return changes, nil
+}
+
+// GetIndexEntries returns the git index entry (mode and blob sha) for each of the given files.
+// Files that are not present in the index are not included in the result.
+func GetIndexEntries(files []string) (map[string]IndexEntry, error) {
+	entries := map[string]IndexEntry{}
+	if len(files) == 0 {
+		return entries, nil
+	}
+
+	cmdArgs := append([]string{"ls-files", "--stage", "-z", "--"}, files...)
+	output, err := executeCommand("git", cmdArgs...)
+	if err != nil {
+		return entries, err
+	}
 
-	files := strings.Split(string(output), "\n")
-	for _, file := range files {
-		if file != "" {
-			modfiles = append(modfiles, file)
+	// each entry has the format '<mode> <sha> <stage>\t<path>'
+	for _, line := range strings.Split(string(output), "\x00") {
+		if line == "" {
+			continue
+		}
+		info, path, found := strings.Cut(line, "\t")
+		fields := strings.Fields(info)
+		if !found || len(fields) != 3 {
+			return entries, fmt.Errorf("unexpected 'git ls-files' output: %s", line)
+		}
+		entries[path] = IndexEntry{
+			Path: path,
+			Mode: fields[0],
+			Sha:  fields[1],
 		}
 	}
-	return modfiles, nil
+	return entries, nil
+}
+
+// ReadIndexBlob returns the content of a blob stored in the git object database
+func ReadIndexBlob(sha string) ([]byte, error) {
+	return executeCommand("git", "cat-file", "blob", sha)
+}
+
+// GitBlobSha returns the sha git assigns to a blob with the given content
+func GitBlobSha(content []byte) string {
+	hash := sha1.New() // #nosec G401 -- git object ids are sha1 hashes
+	fmt.Fprintf(hash, "blob %d\x00", len(content))
+	hash.Write(content)
+	return hex.EncodeToString(hash.Sum(nil))
 }
 
-func AppendToGHActionsSummary(summary string) {
+func AppendToGHActionsSummary(summary string) error {
 	if IsGitHubActions() {
 		summaryPath := os.Getenv("GITHUB_STEP_SUMMARY")
-		writeToGHActionsVar(summaryPath, summary)
+		return writeToGHActionsVar(summaryPath, summary)
 	}
+	return nil
 }
 
-func SendToGHActionsOutput(variable string, output string) {
+func SendToGHActionsOutput(variable string, output string) error {
 	if IsGitHubActions() {
-		writeToGHActionsVar(os.Getenv("GITHUB_OUTPUT"), fmt.Sprintf("%s=%s", variable, output))
+		return writeToGHActionsVar(os.Getenv("GITHUB_OUTPUT"), fmt.Sprintf("%s=%s", variable, output))
 	}
+	return nil
 }
 
 func executeCommand(command string, args ...string) ([]byte, error) {
@@ -131,7 +276,7 @@ func executeCommand(command string, args ...string) ([]byte, error) {
 	output, err := cmd.Output()
 	if err != nil {
 		fmt.Printf("-----------------------------\n")
-		fmt.Printf("Error during 'StageModifiedAndNewFiles'\n")
+		fmt.Printf("Error running '%s'\n", strings.Join(cmd.Args, " "))
 		fmt.Printf("Path: %s\n", cmd.Dir)
 		fmt.Printf("Stderr: %s\n", stderr.String())
 		fmt.Printf("Error: %s\n", err)
@@ -142,19 +287,20 @@ func executeCommand(command string, args ...string) ([]byte, error) {
 	return output, nil
 }
 
-func writeToGHActionsVar(name string, value string) {
+func writeToGHActionsVar(name string, value string) error {
 	if name != "" {
 		f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0644)
 		if err != nil {
-			log.Fatalf("failed opening file: %s", err)
+			return fmt.Errorf("failed opening file: %w", err)
 		}
 		defer f.Close()
 
 		_, err = fmt.Fprintln(f, value)
 		if err != nil {
-			log.Fatalf("failed writing to file: %s", err)
+			return fmt.Errorf("failed writing to file: %w", err)
 		}
 	}
+	return nil
 }
 
 func IsGitHubActions() bool {
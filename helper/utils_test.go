@@ -0,0 +1,188 @@
+package github_helper
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// create a git repository in a temporary directory and change into it
+func initTestRepo(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Chdir(dir)
+	runGit(t, "init", "-q")
+	runGit(t, "config", "user.email", "test@example.com")
+	runGit(t, "config", "user.name", "test")
+}
+
+func runGit(t *testing.T, args ...string) {
+	t.Helper()
+	output, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v: %s", args, err, output)
+	}
+}
+
+func writeTestFile(t *testing.T, path string, content string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte(content), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildPathspecs(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   []string
+		exclude []string
+		want    []string
+	}{
+		{"empty", nil, nil, []string{}},
+		{"files", []string{"docs/*.md", "README.md"}, nil, []string{"docs/*.md", "README.md"}},
+		{"exclude only", nil, []string{"*.lock"}, []string{".", ":(exclude)*.lock"}},
+		{"files and exclude", []string{"docs"}, []string{"docs/tmp/*", "*.bak"}, []string{"docs", ":(exclude)docs/tmp/*", ":(exclude)*.bak"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := BuildPathspecs(tt.files, tt.exclude)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("BuildPathspecs(%v, %v) = %v, want %v", tt.files, tt.exclude, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetModifiedFilesUnmatchedPathspecs(t *testing.T) {
+	initTestRepo(t)
+	writeTestFile(t, "docs/a.md", "a")
+	writeTestFile(t, "src/main.go", "package main")
+	runGit(t, "add", "-A")
+	runGit(t, "commit", "-q", "-m", "initial")
+	writeTestFile(t, "docs/a.md", "a changed")
+	writeTestFile(t, "docs/new.md", "new")
+	writeTestFile(t, "src/main.go", "package main // changed")
+
+	tests := []struct {
+		name       string
+		addNew     bool
+		files      []string
+		exclude    []string
+		wantChange []FileChange
+	}{
+		{
+			name:   "one glob matches nothing",
+			addNew: true,
+			files:  []string{"docs/*.md", "nomatch/*.md"},
+			wantChange: []FileChange{
+				{Status: "M", Path: "docs/a.md"},
+				{Status: "A", Path: "docs/new.md"},
+			},
+		},
+		{
+			name:   "no glob matches",
+			addNew: true,
+			files:  []string{"nomatch/*.md", "other/*.txt"},
+		},
+		{
+			name:    "no glob matches with exclude",
+			addNew:  true,
+			files:   []string{"nomatch/*.md"},
+			exclude: []string{"src/*"},
+		},
+		{
+			name:  "modified only, glob matches only new files",
+			files: []string{"docs/new.md"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runGit(t, "reset", "-q")
+			pathspecs := BuildPathspecs(tt.files, tt.exclude)
+			var changes []FileChange
+			var err error
+			if tt.addNew {
+				changes, err = GetModifiedAndNewFiles(pathspecs...)
+			} else {
+				changes, err = GetModifiedFiles(pathspecs...)
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(changes) != len(tt.wantChange) || (len(changes) > 0 && !reflect.DeepEqual(changes, tt.wantChange)) {
+				t.Errorf("changes = %v, want %v", changes, tt.wantChange)
+			}
+		})
+	}
+}
+
+func TestParseNameStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    []FileChange
+		wantErr bool
+	}{
+		{"empty", "", nil, false},
+		{
+			name:   "modified, added and deleted",
+			output: "M\x00a.txt\x00A\x00dir/new file.txt\x00D\x00old.txt\x00",
+			want: []FileChange{
+				{Status: "M", Path: "a.txt"},
+				{Status: "A", Path: "dir/new file.txt"},
+				{Status: "D", Path: "old.txt"},
+			},
+		},
+		{
+			name:   "rename and copy with score",
+			output: "R100\x00old.txt\x00new.txt\x00C075\x00src.txt\x00copy.txt\x00T\x00link\x00",
+			want: []FileChange{
+				{Status: "R", OldPath: "old.txt", Path: "new.txt"},
+				{Status: "C", OldPath: "src.txt", Path: "copy.txt"},
+				{Status: "T", Path: "link"},
+			},
+		},
+		{
+			name:   "path with newline",
+			output: "M\x00line\nbreak.txt\x00",
+			want:   []FileChange{{Status: "M", Path: "line\nbreak.txt"}},
+		},
+		{"rename without new path", "R100\x00old.txt", []FileChange(nil), true},
+		{"status without path", "M", []FileChange(nil), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNameStatus(tt.output)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseNameStatus(%q) = %v, want %v", tt.output, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGitBlobSha(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		// values from 'git hash-object --stdin'
+		{"", "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"},
+		{"hello\n", "ce013625030ba8dba906f756967f9e9ca394464a"},
+	}
+	for _, tt := range tests {
+		got := GitBlobSha([]byte(tt.content))
+		if got != tt.want {
+			t.Errorf("GitBlobSha(%q) = %s, want %s", tt.content, got, tt.want)
+		}
+	}
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
-	"encoding/pem"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"os"
+	"os/signal"
 	"regexp"
 	"strings"
+	"syscall"
 	"time"
 
 	gh "github.com/arcezd/github-app-commit-action/helper"
@@ -16,12 +18,39 @@ import (
 const (
 	// github pem env var
 	githubAppPrivateKeyEnvVar = "GH_APP_PRIVATE_KEY"
-	defaultCommitMessage      = "chore: autopublish ${date}"
+	// passphrase of an encrypted private key, from the env so it doesn't show in the process list
+	githubAppPrivateKeyPassphraseEnvVar = "GH_APP_PRIVATE_KEY_PASSPHRASE"
+	// api url set by github actions, also on github enterprise server
+	githubApiUrlEnvVar       = "GITHUB_API_URL"
+	defaultApiUrl            = "https://api.github.com"
+	defaultCommitMessage     = "chore: autopublish ${date}"
+	defaultUploadConcurrency = 4
+	defaultPushRetries       = 3
+	defaultTokenPermissions  = "contents:write"
+	// time to revoke the installation token, also after the run was cancelled
+	revokeTokenTimeout = 10 * time.Second
+)
+
+// exit codes
+const (
+	exitOK        = 0
+	exitUsage     = 2 // invalid flags or inputs
+	exitAuth      = 3 // GitHub App authentication failed
+	exitCommit    = 4 // creating or pushing the commit failed
+	exitConflict  = 5 // the branch has conflicting changes
+	exitTag       = 6 // creating a tag failed
+	exitCancelled = 7 // cancelled by a signal or the run timeout
 )
 
 func main() {
-	var appId, branch, headBranch, repository, privateKeyPemFilename, commitMsg, coauthors, tags string
-	var version, help, force, addNewFiles bool
+	os.Exit(run())
+}
+
+func run() int {
+	var appId, branch, headBranch, repository, privateKeyPemFilename, commitMsg, coauthors, tags, files, exclude, contentSource, tokenPermissions, signerCommand, installationOwner, apiUrl, proxyUrl, caBundle, clientCert, clientKey string
+	var version, help, force, addNewFiles, stagedOnly, allowEmpty, keepToken bool
+	var uploadConcurrency, pushRetries, installationId int
+	var retryBudget, requestTimeout, timeout time.Duration
 
 	// parse flags
 	flag.BoolVar(&help, "help", false, "CLI help")
@@ -30,22 +59,42 @@ func main() {
 	flag.StringVar(&headBranch, "h", "", "GitHub head branch to commit from. Default is the same as branch")
 	flag.StringVar(&branch, "b", "main", "GitHub target branch to commit to")
 	flag.StringVar(&repository, "r", "", "GitHub repository in the format owner/repo")
-	flag.StringVar(&privateKeyPemFilename, "p", "", fmt.Sprintf("Path to the private key pem file. %s env variable has priority over this", githubAppPrivateKeyEnvVar))
+	flag.StringVar(&apiUrl, "api-url", defaultApiUrl, fmt.Sprintf("GitHub API url, use 'https://<host>/api/v3' for GitHub Enterprise Server. %s env variable is used when not set", githubApiUrlEnvVar))
+	flag.StringVar(&proxyUrl, "proxy", "", "Proxy url for the GitHub API calls. HTTPS_PROXY and NO_PROXY env variables are used when not set")
+	flag.StringVar(&caBundle, "ca-bundle", "", "Path to a pem file with CA certificates to trust in addition to the system ones")
+	flag.StringVar(&clientCert, "client-cert", "", "Path to the pem client certificate for mutual TLS")
+	flag.StringVar(&clientKey, "client-key", "", "Path to the pem private key of the client certificate")
+	flag.DurationVar(&retryBudget, "retry-budget", gh.DefaultRetryBudget, "Maximum total time spent retrying GitHub API calls after server errors, network errors or rate limits, shared by all the calls of the run")
+	flag.DurationVar(&requestTimeout, "request-timeout", gh.DefaultRequestTimeout, "Timeout of a single GitHub API request")
+	flag.DurationVar(&timeout, "timeout", 0, "Timeout of the whole run, e.g. 10m. No timeout when zero")
+	flag.IntVar(&installationId, "installation-id", 0, "GitHub app installation id, to skip looking the installation up")
+	flag.StringVar(&installationOwner, "installation-owner", "", "Organization or user to look the app installation up from, instead of the repository")
+	flag.BoolVar(&keepToken, "keep-token", false, "Keep the installation tokens valid, instead of revoking them when the run ends")
+	flag.StringVar(&tokenPermissions, "token-permissions", defaultTokenPermissions, "Permissions of the installation token, separated by commas or newlines, e.g. 'contents:write, workflows:write'. The token is also restricted to the repository")
+	flag.StringVar(&privateKeyPemFilename, "p", "", fmt.Sprintf("Paths to the private key pem files, separated by commas or newlines. Several keys are tried in order, e.g. during a key rotation. %s env variable has priority over this", githubAppPrivateKeyEnvVar))
+	flag.StringVar(&signerCommand, "jwt-signer-command", "", "Command signing the app JWT instead of a private key, e.g. with a KMS. It reads the signing input from stdin and prints the RS256 signature, raw or base64 encoded")
 	flag.StringVar(&commitMsg, "m", defaultCommitMessage, "Commit message")
 	flag.StringVar(&coauthors, "c", "", "Coauthors in the format 'Name1 <email1>, Name2 <email2>'")
 	flag.StringVar(&tags, "t", "", "Tags separated by commass, 'tag1, tag2, tag3'")
 	flag.BoolVar(&addNewFiles, "a", true, "Add new files to the commit")
+	flag.BoolVar(&stagedOnly, "staged-only", false, "Commit only the files already staged in the git index, without running 'git add'")
+	flag.StringVar(&contentSource, "content-source", gh.ContentSourceIndex, fmt.Sprintf("Where to read file contents from, '%s' or '%s'", gh.ContentSourceIndex, gh.ContentSourceWorkingTree))
+	flag.IntVar(&uploadConcurrency, "upload-concurrency", defaultUploadConcurrency, "Maximum number of files uploaded to GitHub in parallel")
+	flag.BoolVar(&allowEmpty, "allow-empty", false, "Create the commit even when there are no changes")
+	flag.IntVar(&pushRetries, "push-retries", defaultPushRetries, "Times to re-apply the changes on top of the branch when it moves while pushing")
+	flag.StringVar(&files, "files", "", "Paths or glob patterns of the files to commit, separated by commas or newlines. Default is all changed files")
+	flag.StringVar(&exclude, "exclude", "", "Paths or glob patterns of the files to leave out of the commit, separated by commas or newlines")
 	flag.BoolVar(&force, "f", false, "Force push to the branch")
 	flag.Parse()
 
 	if help {
 		flag.PrintDefaults()
-		return
+		return exitOK
 	}
 
 	if version {
 		fmt.Println(BuildVersion)
-		return
+		return exitOK
 	}
 
 	// parse repository to get owner and repo
@@ -56,10 +105,10 @@ func main() {
 		validRepoPattern := `^([a-zA-Z0-9_-]+)/([a-zA-Z0-9_-]+)$`
 		re := regexp.MustCompile(validRepoPattern)
 		matches := re.FindStringSubmatch(repository)
-		
+
 		if matches == nil {
 			// return error, because the input is not in the expected format
-			panic(fmt.Errorf("invalid repository format '%s', expected format is 'owner/repo'", repository))
+			return exitWithError(exitUsage, fmt.Errorf("invalid repository format '%s', expected format is 'owner/repo'", repository))
 		}
 		// if valid, assign owner and repo
 		repo.Owner = matches[1]
@@ -68,34 +117,86 @@ func main() {
 	} else {
 		// return error, because the repository is required
 		flag.PrintDefaults()
-		panic(fmt.Errorf("repository flag is required. Use -r flag to specify the repository in the format owner/repo"))
+		return exitWithError(exitUsage, fmt.Errorf("repository flag is required. Use -r flag to specify the repository in the format owner/repo"))
 	}
 
 	if headBranch == "" {
 		headBranch = branch
 	}
 
+	if contentSource != gh.ContentSourceIndex && contentSource != gh.ContentSourceWorkingTree {
+		return exitWithError(exitUsage, fmt.Errorf("invalid content source '%s', expected '%s' or '%s'", contentSource, gh.ContentSourceIndex, gh.ContentSourceWorkingTree))
+	}
+
 	// sign the JWT token with the private key
 	if appId == "" {
-		panic("GitHub app id is required. Use -i flag to specify the GitHub app id")
+		return exitWithError(exitUsage, fmt.Errorf("GitHub app id is required. Use -i flag to specify the GitHub app id"))
+	}
+
+	client := gh.NewClient(appId)
+	if !isFlagSet("api-url") && os.Getenv(githubApiUrlEnvVar) != "" {
+		apiUrl = os.Getenv(githubApiUrlEnvVar)
 	}
-	
+	err := client.SetBaseUrl(apiUrl)
+	if err != nil {
+		return exitWithError(exitUsage, err)
+	}
+	client.RetryBudget = retryBudget
+	client.RequestTimeout = requestTimeout
+	client.TokenPermissions, err = gh.ParsePermissions(splitList(tokenPermissions))
+	if err != nil {
+		return exitWithError(exitUsage, err)
+	}
+	if installationId < 0 {
+		return exitWithError(exitUsage, fmt.Errorf("invalid installation id %d", installationId))
+	}
+	client.InstallationId = installationId
+	client.InstallationOwner = installationOwner
+	defer printRateLimit(client)
+	err = client.ConfigureTransport(gh.TransportOptions{
+		ProxyUrl:       proxyUrl,
+		CABundleFile:   caBundle,
+		ClientCertFile: clientCert,
+		ClientKeyFile:  clientKey,
+	})
+	if err != nil {
+		return exitWithError(exitUsage, err)
+	}
+	// cancel the jwt signing command and the api calls when the workflow is cancelled (SIGINT, then SIGTERM) or on timeout
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	privateKeyPemString := os.Getenv(githubAppPrivateKeyEnvVar)
+	passphrase := os.Getenv(githubAppPrivateKeyPassphraseEnvVar)
 
-	if privateKeyPemString != "" {
-		// validate that the format for the private key is correct
-		block, _ := pem.Decode([]byte(privateKeyPemString))
-		if block == nil || block.Type != "RSA PRIVATE KEY" {
-			log.Fatal("failed to decode PEM block containing private key")
+	if signerCommand != "" {
+		// sign the JWT token with an external command, the private key is not available
+		err := client.SetSigner(ctx, gh.NewShellCommandSigner(signerCommand))
+		if err != nil {
+			if ctx.Err() != nil {
+				return exitWithError(exitCancelled, err)
+			}
+			return exitWithError(exitAuth, err)
 		}
+	} else if privateKeyPemString != "" {
 		// sign the JWT token with the private key from the env var
-		gh.SignJWTAppToken(appId, []byte(privateKeyPemString))
+		err := client.SignJWTAppToken(ctx, []byte(privateKeyPemString), passphrase)
+		if err != nil {
+			return exitWithError(exitAuth, fmt.Errorf("invalid private key in %s: %w", githubAppPrivateKeyEnvVar, err))
+		}
 	} else if privateKeyPemFilename != "" {
 		// sign the JWT token with the private key from the filename
-		gh.SignJWTAppTokenWithFilename(appId, privateKeyPemFilename)
+		err := client.SignJWTAppTokenWithFilenames(ctx, splitList(privateKeyPemFilename), passphrase)
+		if err != nil {
+			return exitWithError(exitAuth, err)
+		}
 	} else {
-		errMsg := fmt.Sprintf("You need to provide a private key in the environment variable %s or a filename with the -p flag", githubAppPrivateKeyEnvVar)
-		panic(errMsg)
+		return exitWithError(exitUsage, fmt.Errorf("you need to provide a private key in the environment variable %s, a filename with the -p flag or a signing command with the -jwt-signer-command flag", githubAppPrivateKeyEnvVar))
 	}
 
 	// parse coauthors
@@ -110,7 +211,7 @@ func main() {
 
 			matches := re.FindStringSubmatch(coauthor)
 			if matches == nil {
-				log.Fatalf("invalid coauthor format '%s', expected format is 'Name <email@example.com>'", coauthor)
+				return exitWithError(exitUsage, fmt.Errorf("invalid coauthor format '%s', expected format is 'Name <email@example.com>'", coauthor))
 			}
 			// if valid, assign name and email
 			name := matches[1]
@@ -128,14 +229,32 @@ func main() {
 		commitMsg = fmt.Sprintf("chore: autopublish %s", dt.Format(time.RFC3339))
 	}
 
-	token := gh.GenerateInstallationAppToken(repo)
-	gh.SetGithubAppToken(&token)
+	token, err := client.GenerateInstallationAppToken(ctx, repo)
+	if err != nil {
+		if ctx.Err() != nil {
+			return exitWithError(exitCancelled, err)
+		}
+		return exitWithError(exitAuth, err)
+	}
+	err = client.SetGithubAppToken(&token)
+	if err != nil {
+		return exitWithError(exitAuth, err)
+	}
+	if !keepToken {
+		// revoke on success, failure and cancellation, as signals only cancel the context
+		defer revokeToken(client)
+	}
+	err = gh.SendToGHActionsOutput("key-fingerprint", client.KeyFingerprint())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
 	//onBehalfOf := gh.GitHubOrg{
 	//	Name:  "BitsCR",
 	//	Slug:  "bits-cr",
 	//	Email: "dev@bits.cr",
 	//}
-	commitSha := gh.CommitAndPush(
+	commitResult, err := client.CommitAndPush(
+		ctx,
 		repo,
 		gh.GitCommit{
 			Branch:     branch,
@@ -144,12 +263,32 @@ func main() {
 			Coauthors:  &coauthorsParam,
 			//OnBehalfOf: &onBehalfOf,
 			Options: gh.CommitOptions{
-				AddNewFiles: addNewFiles,
-				Force:       force,
+				AddNewFiles:       addNewFiles,
+				Force:             force,
+				Files:             splitList(files),
+				Exclude:           splitList(exclude),
+				StagedOnly:        stagedOnly,
+				ContentSource:     contentSource,
+				UploadConcurrency: uploadConcurrency,
+				AllowEmpty:        allowEmpty,
+				PushRetries:       pushRetries,
 			},
 		},
 	)
+	if err != nil {
+		if ctx.Err() != nil {
+			return exitWithError(exitCancelled, err)
+		}
+		if errors.Is(err, gh.ErrConflict) {
+			return exitWithError(exitConflict, err)
+		}
+		return exitWithError(exitCommit, err)
+	}
 
+	if !commitResult.Changed && tags != "" {
+		// tag the head commit, so workflows tagging every run still get their tags
+		fmt.Printf("No commit was created, tagging the head commit '%s'\n", commitResult.HeadSha)
+	}
 	if tags != "" {
 		// split tags by comma
 		tagsList := strings.Split(tags, ",")
@@ -157,11 +296,69 @@ func main() {
 		for _, tag := range tagsList {
 			// remove leading and trailing spaces
 			tag = strings.TrimSpace(tag)
-			gh.CreateTagAndPush(gh.GitTag{
+			_, err = client.CreateTagAndPush(ctx, gh.GitTag{
 				TagName:   tag,
 				Message:   commitMsg,
-				CommitSha: commitSha,
+				CommitSha: commitResult.HeadSha,
 			})
+			if err != nil {
+				if ctx.Err() != nil {
+					return exitWithError(exitCancelled, err)
+				}
+				return exitWithError(exitTag, err)
+			}
+		}
+	}
+	return exitOK
+}
+
+// revoke the installation token with a new context, the run context may be cancelled
+func revokeToken(client *gh.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), revokeTokenTimeout)
+	defer cancel()
+	err := client.RevokeInstallationToken(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		return
+	}
+	fmt.Println("Installation token revoked")
+}
+
+// print the GitHub API rate limit left after the run
+func printRateLimit(client *gh.Client) {
+	rateLimit := client.RateLimit()
+	if rateLimit.Limit > 0 {
+		fmt.Printf("GitHub API rate limit: %d of %d requests remaining, resets at %s\n", rateLimit.Remaining, rateLimit.Limit, rateLimit.Reset.Format(time.RFC3339))
+	}
+}
+
+// check if the flag was passed in the command line
+func isFlagSet(name string) bool {
+	found := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
+// print the error and return the exit code
+func exitWithError(code int, err error) int {
+	fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+	return code
+}
+
+// split a list separated by commas or newlines, ignoring empty items
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == '\n'
+	}) {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
 		}
 	}
+	return items
 }